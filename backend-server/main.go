@@ -1,18 +1,33 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 )
 
 var ContainerName string
 
 func main() {
 	ContainerName = os.Getenv("CONTAINER_NAME")
-	http.HandleFunc("/", HelloHandler)
-	http.HandleFunc("/health", HealthHandler)
-	err := http.ListenAndServe(":8080", nil)
+	defer initTracing()()
+	http.HandleFunc("/", traced("hello", HelloHandler))
+	http.HandleFunc("/health", traced("health", HealthHandler))
+	http.HandleFunc("/grpc.health.v1.Health/Check", traced("grpc-health", GRPCHealthHandler))
+	var err error
+	tlsDir := os.Getenv("TLS_DIR")
+	if tlsDir != "" {
+		err = listenAndServeMutualTLS(tlsDir)
+	} else {
+		// h2c lets load balancers speak HTTP/2 to the backend without TLS
+		err = http.ListenAndServe(":8080", h2c.NewHandler(http.DefaultServeMux, &http2.Server{}))
+	}
 	if err != nil {
 		fmt.Println("Error starting server: ", err)
 		return
@@ -20,12 +35,61 @@ func main() {
 }
 
 func HelloHandler(w http.ResponseWriter, r *http.Request) {
+	echoRequestID(w, r)
+	w.Header().Set("X-Backend-Protocol", r.Proto)
 	_, err := fmt.Fprintf(w, "Hello from, %s!", ContainerName)
 	if err != nil {
 		return
 	}
 }
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	echoRequestID(w, r)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 }
+
+// servingHealthCheckResponse is a grpc.health.v1.HealthCheckResponse with the status SERVING,
+// behind the 5 byte prefix of an uncompressed gRPC message
+var servingHealthCheckResponse = []byte{0, 0, 0, 0, 2, 0x08, 0x01}
+
+// GRPCHealthHandler answers the standard gRPC health check for services run in gRPC mode
+func GRPCHealthHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	_, err = w.Write(servingHealthCheckResponse)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// listenAndServeMutualTLS only accepts clients with a certificate from the CA of the orchestrator
+func listenAndServeMutualTLS(tlsDir string) error {
+	caPEM, err := os.ReadFile(filepath.Join(tlsDir, "ca.pem"))
+	if err != nil {
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPEM)
+	server := &http.Server{
+		Addr: ":8080",
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	return server.ListenAndServeTLS(filepath.Join(tlsDir, "cert.pem"), filepath.Join(tlsDir, "key.pem"))
+}
+
+// echoRequestID sends back the request id set by the load balancer
+func echoRequestID(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID != "" {
+		w.Header().Set("X-Request-ID", requestID)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"time"
+)
+
+var tracer = otel.Tracer("backend-server")
+
+// initTracing sets up the span exporter picked by TRACE_EXPORTER, tracing is a no-op when it is unset.
+// The returned function flushes the spans that are still buffered.
+func initTracing() func() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	exporter, err := newTraceExporter()
+	if err != nil {
+		fmt.Println("Error creating trace exporter:", err)
+		return func() {}
+	}
+	if exporter == nil {
+		return func() {}
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("backend-server"),
+			attribute.String("container.name", ContainerName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := provider.Shutdown(ctx)
+		if err != nil {
+			fmt.Println("Error flushing traces:", err)
+		}
+	}
+}
+
+func newTraceExporter() (sdktrace.SpanExporter, error) {
+	switch os.Getenv("TRACE_EXPORTER") {
+	case "otlp":
+		return otlptracehttp.New(context.Background())
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		file, err := os.OpenFile(os.Getenv("TRACE_FILE"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	}
+	return nil, nil
+}
+
+// traced wraps a handler in a server span that continues the trace of the traceparent header
+func traced(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("request.id", r.Header.Get("X-Request-ID")),
+			))
+		defer span.End()
+		handler(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AccessLogJSON   = "json"
+	AccessLogLogfmt = "logfmt"
+
+	AccessLogOff   = "off"
+	AccessLogError = "error"
+	AccessLogInfo  = "info"
+
+	defaultAccessLogFields = "method,path,status,bytes,upstream,upstream_latency,latency,client_ip,request_id,retries"
+
+	// entries waiting to be written, new entries are dropped when it is full
+	accessLogBufferSize    = 4096
+	accessLogFlushInterval = time.Second
+)
+
+var accessLogDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "lb_access_log_dropped_total",
+	Help: "Access log entries dropped because the log writer could not keep up.",
+})
+
+type accessLogConfig struct {
+	format     string
+	fields     []string
+	sampleRate float64
+	level      string
+}
+
+func newAccessLogConfig(service *Service) *accessLogConfig {
+	config := &accessLogConfig{
+		format:     service.AccessLogFormat,
+		sampleRate: service.AccessLogSampleRate,
+		level:      service.AccessLogLevel,
+	}
+	if config.format != AccessLogLogfmt {
+		config.format = AccessLogJSON
+	}
+	if config.sampleRate <= 0 || config.sampleRate > 1 {
+		config.sampleRate = 1
+	}
+	if config.level != AccessLogOff && config.level != AccessLogError {
+		config.level = AccessLogInfo
+	}
+	fields := service.AccessLogFields
+	if fields == "" {
+		fields = defaultAccessLogFields
+	}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			config.fields = append(config.fields, field)
+		}
+	}
+	return config
+}
+
+// accessLogEntry is filled on the request path and only formatted by the log writer
+type accessLogEntry struct {
+	config          *accessLogConfig
+	time            time.Time
+	method          string
+	path            string
+	status          int
+	bytes           int64
+	upstream        string
+	upstreamLatency time.Duration
+	latency         time.Duration
+	clientIP        string
+	requestID       string
+	retries         int
+}
+
+func (e *accessLogEntry) value(field string) interface{} {
+	switch field {
+	case "method":
+		return e.method
+	case "path":
+		return e.path
+	case "status":
+		return e.status
+	case "bytes":
+		return e.bytes
+	case "upstream":
+		return e.upstream
+	case "upstream_latency":
+		return float64(e.upstreamLatency.Microseconds()) / 1000
+	case "latency":
+		return float64(e.latency.Microseconds()) / 1000
+	case "client_ip":
+		return e.clientIP
+	case "request_id":
+		return e.requestID
+	case "retries":
+		return e.retries
+	}
+	return nil
+}
+
+func (e *accessLogEntry) format(w *bufio.Writer) {
+	timestamp := e.time.UTC().Format(time.RFC3339Nano)
+	if e.config.format == AccessLogLogfmt {
+		w.WriteString("time=" + timestamp)
+		for _, field := range e.config.fields {
+			value := e.value(field)
+			if value == nil {
+				continue
+			}
+			w.WriteString(" " + field + "=" + logfmtValue(value))
+		}
+		w.WriteByte('\n')
+		return
+	}
+	w.WriteString(`{"time":"` + timestamp + `"`)
+	for _, field := range e.config.fields {
+		value := e.value(field)
+		if value == nil {
+			continue
+		}
+		dat, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		w.WriteString(`,"` + field + `":`)
+		w.Write(dat)
+	}
+	w.WriteString("}\n")
+}
+
+func logfmtValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " =\"") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+var accessLogEntries = make(chan *accessLogEntry, accessLogBufferSize)
+
+// receives the channel closed by the log writer once the queued entries are written
+var accessLogStop = make(chan chan struct{})
+
+// accessLogWriter writes the entries to stdout through a buffer, flushing once the queue runs dry
+// or every accessLogFlushInterval so a steady trickle of requests still shows up quickly
+func accessLogWriter() {
+	w := bufio.NewWriterSize(os.Stdout, 64<<10)
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-accessLogEntries:
+			entry.format(w)
+			if len(accessLogEntries) == 0 {
+				w.Flush()
+			}
+		case <-ticker.C:
+			w.Flush()
+		case done := <-accessLogStop:
+			for len(accessLogEntries) > 0 {
+				(<-accessLogEntries).format(w)
+			}
+			w.Flush()
+			close(done)
+			return
+		}
+	}
+}
+
+// stopAccessLogWriter writes out the entries still queued, it is called once no request is served anymore
+func stopAccessLogWriter() {
+	done := make(chan struct{})
+	accessLogStop <- done
+	<-done
+}
+
+// logAccess queues the entry without ever blocking the request
+func logAccess(entry *accessLogEntry) {
+	config := entry.config
+	if config.level == AccessLogOff {
+		return
+	}
+	if config.level == AccessLogError && entry.status < http.StatusInternalServerError {
+		return
+	}
+	if config.sampleRate < 1 && rand.Float64() >= config.sampleRate {
+		return
+	}
+	select {
+	case accessLogEntries <- entry:
+	default:
+		accessLogDropped.Inc()
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder remembers what was sent to the client for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// when the status was sent
+	headerTime time.Time
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+		w.headerTime = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.headerTime = time.Now()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -2,26 +2,40 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"gorm.io/gorm"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
-func apis(db *gorm.DB) {
-	http.HandleFunc("/lb-health", HealthHandler)
-	http.HandleFunc("/service-update", func(w http.ResponseWriter, r *http.Request) {
-		ServiceUpdateHandler(w, r, db)
-	})
-	err := http.ListenAndServe(":3210", nil)
-	if err != nil {
-		fmt.Println("Error starting lb server: ", err)
-		return
-	}
+func apis(listener net.Listener) *http.Server {
+	// own mux so the admin endpoints are not reachable through the proxy port
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/lb-health", HealthHandler)
+	adminMux.HandleFunc("/circuit-breakers", CircuitBreakersHandler)
+	adminMux.HandleFunc("/request-rates", RequestRatesHandler)
+	adminMux.HandleFunc("/in-flight", InFlightHandler)
+	adminMux.HandleFunc("/cache/purge", CachePurgeHandler)
+	adminMux.Handle("/metrics", promhttp.HandlerFor(newMetricsRegistry(), promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: adminMux}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("Error starting lb server: ", err)
+		}
+	}()
+	return server
 }
 
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(calculateRequestRate())
 	if err != nil {
@@ -37,20 +51,93 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func CircuitBreakersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dat, err := json.Marshal(getCircuitBreakerStatuses())
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	_, errWrite := w.Write(dat)
+	if errWrite != nil {
+		log.Printf("Error writing circuit breakers response: %s", errWrite)
+		return
+	}
+}
+
 func calculateRequestRate() float64 {
-	now := time.Now()
-	thirtySecondsAgo := now.Add(-30 * time.Second)
-	count := 0
-	for i := len(requestLog) - 1; i >= 0; i-- {
-		if requestLog[i].Before(thirtySecondsAgo) {
-			break
+	return requests.Rate(30 * time.Second)
+}
+
+func RequestRatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dat, err := json.Marshal(getRequestRates())
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	_, errWrite := w.Write(dat)
+	if errWrite != nil {
+		log.Printf("Error writing request rates response: %s", errWrite)
+		return
+	}
+}
+
+// InFlightHandler reports the requests in flight to every backend, the orchestrator waits for a
+// draining backend to reach zero before stopping it
+func InFlightHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dat, err := json.Marshal(getInFlightRequests())
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	_, errWrite := w.Write(dat)
+	if errWrite != nil {
+		log.Printf("Error writing in-flight response: %s", errWrite)
+		return
+	}
+}
+
+func getInFlightRequests() map[string]int64 {
+	mux.Lock()
+	defer mux.Unlock()
+	inFlight := make(map[string]int64)
+	for _, s := range allServices() {
+		for _, backend := range s.service.Backends {
+			inFlight[backend.ContainerName] = atomic.LoadInt64(&backend.activeRequests)
 		}
-		count++
 	}
-	return float64(count) / 30.0
+	return inFlight
 }
 
-func ServiceUpdateHandler(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+// CachePurgeHandler drops cached responses, of every service unless the service parameter names one.
+// The host, path and prefix parameters only drop the responses they match.
+func CachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	purged := purgeCaches(query.Get("service"), query.Get("host"), query.Get("path"), query.Get("prefix"))
+	w.Header().Set("Content-Type", "application/json")
+	dat, err := json.Marshal(map[string]int{"purged": purged})
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(200)
-	getService(db)
+	_, errWrite := w.Write(dat)
+	if errWrite != nil {
+		log.Printf("Error writing cache purge response: %s", errWrite)
+		return
+	}
 }
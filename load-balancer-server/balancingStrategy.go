@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	StrategyRoundRobin         = "round-robin"
+	StrategyLeastConnections   = "least-connections"
+	StrategyPowerOfTwoChoices  = "power-of-two-choices"
+	StrategyWeightedRoundRobin = "weighted-round-robin"
+	StrategyRandom             = "random"
+	StrategyConsistentHash     = "consistent-hash"
+)
+
+// Strategy picks the backend for the next request out of the healthy backends of the service.
+// Next is always called with mux held and a non-empty list of backends, key is only set for
+// strategies that pin clients to a backend.
+type Strategy interface {
+	Next(backends []*BackendServer, key string) *BackendServer
+}
+
+// memberAware strategies are also given every backend of the service, each time its definition is set
+type memberAware interface {
+	setMembers(backends []*BackendServer)
+}
+
+func newStrategy(name string) Strategy {
+	switch name {
+	case "", StrategyRoundRobin:
+		return &roundRobin{}
+	case StrategyLeastConnections:
+		return &leastConnections{}
+	case StrategyPowerOfTwoChoices:
+		return &powerOfTwoChoices{}
+	case StrategyWeightedRoundRobin:
+		return &weightedRoundRobin{currentWeights: make(map[string]int)}
+	case StrategyRandom:
+		return &random{}
+	case StrategyConsistentHash:
+		return &consistentHash{}
+	default:
+		fmt.Println("Unknown balancing strategy", name, "falling back to", StrategyRoundRobin)
+		return &roundRobin{}
+	}
+}
+
+type roundRobin struct {
+	nextBackendIndex int
+}
+
+func (s *roundRobin) Next(backends []*BackendServer, key string) *BackendServer {
+	backend := backends[s.nextBackendIndex%len(backends)]
+	s.nextBackendIndex++
+	return backend
+}
+
+// leastConnections picks the backend with the fewest in-flight requests,
+// rotating the starting point so ties do not always land on the first backend
+type leastConnections struct {
+	offset int
+}
+
+func (s *leastConnections) Next(backends []*BackendServer, key string) *BackendServer {
+	s.offset++
+	var best *BackendServer
+	var bestActive int64
+	for i := 0; i < len(backends); i++ {
+		backend := backends[(s.offset+i)%len(backends)]
+		active := atomic.LoadInt64(&backend.activeRequests)
+		if best == nil || active < bestActive {
+			best = backend
+			bestActive = active
+		}
+	}
+	return best
+}
+
+// powerOfTwoChoices samples two random backends and picks the one with fewer in-flight requests
+type powerOfTwoChoices struct{}
+
+func (s *powerOfTwoChoices) Next(backends []*BackendServer, key string) *BackendServer {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := backends[i], backends[j]
+	if atomic.LoadInt64(&b.activeRequests) < atomic.LoadInt64(&a.activeRequests) {
+		return b
+	}
+	return a
+}
+
+// weightedRoundRobin is the smooth weighted round-robin used by nginx,
+// it spreads the picks of heavy backends instead of sending them in bursts
+type weightedRoundRobin struct {
+	currentWeights map[string]int
+}
+
+// Next only sees the backends available for the request, the weights of the others are kept
+// so a retry or an ejection does not lose the position of every backend
+func (s *weightedRoundRobin) Next(backends []*BackendServer, key string) *BackendServer {
+	total := 0
+	var best *BackendServer
+	for _, backend := range backends {
+		weight := backend.weight()
+		total += weight
+		s.currentWeights[backend.ContainerName] += weight
+		if best == nil || s.currentWeights[backend.ContainerName] > s.currentWeights[best.ContainerName] {
+			best = backend
+		}
+	}
+	s.currentWeights[best.ContainerName] -= total
+	return best
+}
+
+// setMembers forgets the backends that were removed from the service
+func (s *weightedRoundRobin) setMembers(backends []*BackendServer) {
+	current := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		current[backend.ContainerName] = true
+	}
+	for containerName := range s.currentWeights {
+		if !current[containerName] {
+			delete(s.currentWeights, containerName)
+		}
+	}
+}
+
+type random struct{}
+
+func (s *random) Next(backends []*BackendServer, key string) *BackendServer {
+	return backends[rand.Intn(len(backends))]
+}
+
+func (b *BackendServer) weight() int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStatusHeader tells the client how the cache answered: HIT, STALE, REVALIDATED, MISS or BYPASS
+const CacheStatusHeader = "X-Cache"
+
+const (
+	defaultCacheMemoryMB    = 64
+	defaultCacheMaxObjectKB = 1024
+	defaultCacheDiskMB      = 1024
+	// a revalidation in the background gives up after this long
+	cacheRevalidateTimeout = 30 * time.Second
+	// the largest delta-seconds a cache has to understand
+	maxCacheControlSeconds = 1 << 31
+)
+
+// the disk directories of the services are only ever created below it, CACHE_ROOT moves it
+var defaultCacheRoot = filepath.Join(os.TempDir(), "load-balancer-cache")
+
+func cacheRoot() string {
+	root := os.Getenv("CACHE_ROOT")
+	if root == "" {
+		return defaultCacheRoot
+	}
+	return root
+}
+
+// responses that can be stored without a status specific rule
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+type cacheConfig struct {
+	memoryBytes    int64
+	maxObjectBytes int
+	diskDir        string
+	diskBytes      int64
+}
+
+func getCacheConfig(service *Service) cacheConfig {
+	config := cacheConfig{
+		memoryBytes:    int64(service.CacheMemoryMB) << 20,
+		maxObjectBytes: service.CacheMaxObjectKB << 10,
+		diskBytes:      int64(service.CacheDiskMB) << 20,
+	}
+	if config.memoryBytes <= 0 {
+		config.memoryBytes = defaultCacheMemoryMB << 20
+	}
+	if config.maxObjectBytes <= 0 {
+		config.maxObjectBytes = defaultCacheMaxObjectKB << 10
+	}
+	if config.diskBytes <= 0 {
+		config.diskBytes = defaultCacheDiskMB << 20
+	}
+	if service.CacheDiskDir != "" {
+		// every service gets its own directory, it is emptied when the cache is created
+		config.diskDir = serviceCacheDir(cacheRoot(), service.CacheDiskDir, service.Name)
+	}
+	return config
+}
+
+// serviceCacheDir returns the directory of the service in the cache directory, which is relative to the cache root.
+// The directory is removed when the cache is created, so anything that could lead out of the cache root gets none.
+func serviceCacheDir(root string, cacheDir string, serviceName string) string {
+	if !filepath.IsLocal(cacheDir) {
+		return ""
+	}
+	if serviceName == "" || serviceName == "." || serviceName == ".." || strings.ContainsAny(serviceName, `/\`) {
+		return ""
+	}
+	dir := filepath.Join(root, cacheDir, serviceName)
+	rel, err := filepath.Rel(filepath.Clean(root), dir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return ""
+	}
+	return dir
+}
+
+// httpCache is the shared cache of a service. Responses are kept in memory and, with a disk directory,
+// written through to disk so the ones pushed out of memory can still be served.
+// Concurrent misses for the same key are collapsed into one request to the backends.
+type httpCache struct {
+	config cacheConfig
+	lock   sync.Mutex
+	memory *memoryTier
+	disk   *diskTier
+	// the requests sent to the backends by key, later requests for the key wait for them
+	fetches map[string]chan struct{}
+}
+
+// cacheFetcher sends a request to the backends of the service
+type cacheFetcher func(w http.ResponseWriter, r *http.Request, entry *accessLogEntry)
+
+// newHTTPCache returns nil when the service does not cache
+func newHTTPCache(service *Service) *httpCache {
+	if !service.CacheEnabled {
+		return nil
+	}
+	config := getCacheConfig(service)
+	c := &httpCache{config: config, memory: newMemoryTier(config.memoryBytes), fetches: make(map[string]chan struct{})}
+	if service.CacheDiskDir != "" && config.diskDir == "" {
+		fmt.Println("Cache directory", service.CacheDiskDir, "of service", service.Name, "is outside of the cache root, caching in memory only")
+	}
+	if config.diskDir != "" {
+		disk, err := newDiskTier(config.diskDir, config.diskBytes)
+		if err != nil {
+			fmt.Println("Error creating cache directory", config.diskDir, ", caching in memory only:", err)
+		} else {
+			c.disk = disk
+		}
+	}
+	return c
+}
+
+func (c *httpCache) close() {
+	if c.disk != nil {
+		c.disk.close()
+	}
+}
+
+// get looks the key up in memory and then on disk, an entry read from disk moves back into memory
+func (c *httpCache) get(key string) *cacheEntry {
+	c.lock.Lock()
+	entry := c.memory.get(key)
+	c.lock.Unlock()
+	if entry != nil || c.disk == nil {
+		return entry
+	}
+	entry = c.disk.get(key)
+	if entry != nil {
+		c.lock.Lock()
+		c.memory.put(entry)
+		c.lock.Unlock()
+	}
+	return entry
+}
+
+func (c *httpCache) put(entry *cacheEntry) {
+	c.lock.Lock()
+	c.memory.put(entry)
+	c.lock.Unlock()
+	if c.disk != nil {
+		c.disk.put(entry)
+	}
+}
+
+// lookup returns the key of the request and what is stored under it, following the marker of a response with a Vary header
+func (c *httpCache) lookup(baseKey string, r *http.Request) (string, *cacheEntry) {
+	entry := c.get(baseKey)
+	if entry == nil || !entry.isMarker() {
+		return baseKey, entry
+	}
+	key := variantKey(baseKey, entry.Vary, r)
+	return key, c.get(key)
+}
+
+// store keeps the response of the request, a response with a Vary header leaves a marker under the base key
+func (c *httpCache) store(baseKey string, r *http.Request, entry *cacheEntry) {
+	vary := varyHeaders(entry.Header)
+	entry.Key = baseKey
+	if len(vary) > 0 {
+		c.put(&cacheEntry{Key: baseKey, Vary: vary, StoredAt: entry.StoredAt})
+		entry.Key = variantKey(baseKey, vary, r)
+	}
+	c.put(entry)
+}
+
+// remove drops the entries whose key matches from both tiers and returns how many there were
+func (c *httpCache) remove(match func(key string) bool) int {
+	removed := make(map[string]bool)
+	c.lock.Lock()
+	for key := range c.memory.items {
+		if match(key) {
+			removed[key] = true
+		}
+	}
+	for key := range removed {
+		c.memory.remove(key)
+	}
+	c.lock.Unlock()
+	if c.disk != nil {
+		for _, key := range c.disk.keys() {
+			if match(key) && c.disk.remove(key) {
+				removed[key] = true
+			}
+		}
+	}
+	return len(removed)
+}
+
+// invalidate drops every variant stored for the URI of the base key
+func (c *httpCache) invalidate(baseKey string) {
+	c.remove(func(key string) bool {
+		return strings.HasPrefix(key, baseKey)
+	})
+}
+
+// startFetch registers a request to the backends for the key. It returns false with the channel
+// of the request already in flight, which is closed once that one is done.
+func (c *httpCache) startFetch(key string) (chan struct{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if done, ok := c.fetches[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	c.fetches[key] = done
+	return done, true
+}
+
+func (c *httpCache) endFetch(key string, done chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.fetches, key)
+	close(done)
+}
+
+func (c *httpCache) size() (int64, int64) {
+	c.lock.Lock()
+	memory := c.memory.bytes
+	c.lock.Unlock()
+	if c.disk == nil {
+		return memory, 0
+	}
+	return memory, c.disk.size()
+}
+
+// serve answers the request from the cache when it can and sends it on with fetch when it cannot
+func (c *httpCache) serve(w http.ResponseWriter, r *http.Request, serviceName string, logEntry *accessLogEntry, fetch cacheFetcher) {
+	if !cacheableRequest(r) {
+		c.bypass(w, r, serviceName, logEntry, fetch)
+		return
+	}
+	requestControl := parseCacheControl(r.Header.Values("Cache-Control"))
+	baseKey := cacheBaseKey(r)
+	key, cached := c.lookup(baseKey, r)
+	now := time.Now()
+	if cached != nil && requestControl.acceptsStored(cached, now) {
+		if cached.fresh(now) {
+			cacheRequestsTotal.WithLabelValues(serviceName, "hit").Inc()
+			writeCacheEntry(w, r, cached, now, "HIT")
+			return
+		}
+		if cached.servableStale(now) {
+			c.revalidateInBackground(r, baseKey, key, cached, fetch)
+			cacheRequestsTotal.WithLabelValues(serviceName, "stale").Inc()
+			writeCacheEntry(w, r, cached, now, "STALE")
+			return
+		}
+	}
+	if r.Method == http.MethodHead {
+		// the response to a HEAD request has no body to store
+		c.bypass(w, r, serviceName, logEntry, fetch)
+		return
+	}
+	done, leader := c.startFetch(key)
+	if !leader {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+		// the first request stored the response if it could be stored, otherwise every request goes on its own
+		_, cached = c.lookup(baseKey, r)
+		if now = time.Now(); cached != nil && cached.fresh(now) {
+			cacheRequestsTotal.WithLabelValues(serviceName, "hit").Inc()
+			writeCacheEntry(w, r, cached, now, "HIT")
+			return
+		}
+		c.bypass(w, r, serviceName, logEntry, fetch)
+		return
+	}
+	defer c.endFetch(key, done)
+	if c.fetchAndStore(w, r, baseKey, cached, logEntry, fetch) {
+		cacheRequestsTotal.WithLabelValues(serviceName, "revalidated").Inc()
+	} else {
+		cacheRequestsTotal.WithLabelValues(serviceName, "miss").Inc()
+	}
+}
+
+// fetchAndStore sends the request to the backends, with the validators of the stored entry when there is one,
+// and stores the response. It returns true when the backend confirmed the stored entry.
+func (c *httpCache) fetchAndStore(w http.ResponseWriter, r *http.Request, baseKey string, cached *cacheEntry, logEntry *accessLogEntry, fetch cacheFetcher) bool {
+	upstream := r.Clone(r.Context())
+	// the cache answers the conditions of the client itself, so it needs the full response from the backend
+	upstream.Header.Del("If-None-Match")
+	upstream.Header.Del("If-Modified-Since")
+	if cached != nil {
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			upstream.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			upstream.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	cw := newCacheWriter(w, cached != nil, c.config.maxObjectBytes)
+	fetch(cw, upstream, logEntry)
+	now := time.Now()
+	if cw.notModified {
+		refreshed, ok := cached.refresh(cw.header, now)
+		if ok {
+			c.put(refreshed)
+		} else {
+			c.invalidate(baseKey)
+		}
+		writeCacheEntry(w, r, refreshed, now, "REVALIDATED")
+		return true
+	}
+	if entry := cw.entry(now); entry != nil {
+		c.store(baseKey, r, entry)
+	}
+	return false
+}
+
+// revalidateInBackground refreshes a stale entry while it is still served, unless a request for it is already in flight
+func (c *httpCache) revalidateInBackground(r *http.Request, baseKey string, key string, cached *cacheEntry, fetch cacheFetcher) {
+	done, leader := c.startFetch(key)
+	if !leader {
+		return
+	}
+	// the client does not wait for the revalidation, it must not be canceled when the client goes away
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), cacheRevalidateTimeout)
+	upstream := r.Clone(ctx)
+	go func() {
+		defer cancel()
+		defer c.endFetch(key, done)
+		defer func() {
+			// the reverse proxy aborts a response it cannot copy with a panic, there is no client to abort here
+			if p := recover(); p != nil && p != http.ErrAbortHandler {
+				panic(p)
+			}
+		}()
+		c.fetchAndStore(discardWriter{header: make(http.Header)}, upstream, baseKey, cached, &accessLogEntry{}, fetch)
+	}()
+}
+
+// bypass sends the request on without the cache. A successful unsafe request makes what is stored for the URI stale.
+func (c *httpCache) bypass(w http.ResponseWriter, r *http.Request, serviceName string, logEntry *accessLogEntry, fetch cacheFetcher) {
+	cacheRequestsTotal.WithLabelValues(serviceName, "bypass").Inc()
+	w.Header().Set(CacheStatusHeader, "BYPASS")
+	if isSafeMethod(r.Method) {
+		fetch(w, r, logEntry)
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	fetch(recorder, r, logEntry)
+	if recorder.status >= http.StatusOK && recorder.status < http.StatusBadRequest {
+		c.invalidate(cacheBaseKey(r))
+	}
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+// cacheableRequest is false for requests that must always go to a backend
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// responses to authorized requests are meant for one client, ranges and upgrades are not stored
+	if isGRPCRequest(r) || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(r.Header.Values("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+// cacheControl holds the directives of Cache-Control headers by lower case name
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	directives := make(cacheControl)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds reads a delta-seconds directive, an invalid value counts as zero
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(min(n, maxCacheControlSeconds)) * time.Second, true
+}
+
+// acceptsStored is false when the request directives ask for a response newer than the stored one
+func (cc cacheControl) acceptsStored(entry *cacheEntry, now time.Time) bool {
+	if cc.has("no-cache") {
+		return false
+	}
+	maxAge, ok := cc.seconds("max-age")
+	return !ok || entry.age(now) <= maxAge
+}
+
+// responseFreshness returns how long a response stays fresh and how long it may be served stale after that.
+// It returns false for a response the cache must not store.
+func responseFreshness(status int, header http.Header, now time.Time) (time.Duration, time.Duration, bool) {
+	if !cacheableStatuses[status] || header.Get("Set-Cookie") != "" || header.Get("Trailer") != "" {
+		return 0, 0, false
+	}
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	if directives.has("no-store") || directives.has("private") {
+		return 0, 0, false
+	}
+	for _, name := range varyHeaders(header) {
+		if name == "*" {
+			return 0, 0, false
+		}
+	}
+	fresh, explicit := directives.seconds("s-maxage")
+	if !explicit {
+		fresh, explicit = directives.seconds("max-age")
+	}
+	if expires := header.Get("Expires"); !explicit && expires != "" {
+		explicit = true
+		expiresAt, err := http.ParseTime(expires)
+		if err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			fresh = max(0, expiresAt.Sub(date))
+		}
+	}
+	if directives.has("no-cache") {
+		// stored but checked with the backend every time
+		fresh, explicit = 0, true
+	}
+	if !explicit {
+		return 0, 0, false
+	}
+	if fresh == 0 && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		// without validators a response that is stale right away is never used
+		return 0, 0, false
+	}
+	if directives.has("must-revalidate") || directives.has("proxy-revalidate") {
+		return fresh, 0, true
+	}
+	staleWhileRevalidate, _ := directives.seconds("stale-while-revalidate")
+	return fresh, staleWhileRevalidate, true
+}
+
+// varyHeaders returns the canonical names of the request headers a response varies on, sorted
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// headers of a 304 that do not describe the stored body
+var notModifiedIgnoredHeaders = []string{"Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding"}
+
+// refresh returns the entry with the headers of a 304 from the backend, it returns false when the
+// updated headers no longer allow storing it
+func (e *cacheEntry) refresh(header http.Header, now time.Time) (*cacheEntry, bool) {
+	refreshed := *e
+	refreshed.Header = e.Header.Clone()
+	for name, values := range header {
+		if !slices.Contains(notModifiedIgnoredHeaders, name) {
+			refreshed.Header[name] = values
+		}
+	}
+	refreshed.StoredAt = now
+	refreshed.InitialAge = headerAge(refreshed.Header)
+	fresh, staleWhileRevalidate, ok := responseFreshness(refreshed.Status, refreshed.Header, now)
+	refreshed.FreshFor = fresh
+	refreshed.StaleWhileRevalidate = staleWhileRevalidate
+	return &refreshed, ok
+}
+
+func headerAge(header http.Header) time.Duration {
+	age, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(min(age, maxCacheControlSeconds)) * time.Second
+}
+
+// writeCacheEntry answers with a stored response, or with 304 when it matches the conditions of the client
+func writeCacheEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, now time.Time, cacheStatus string) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.Itoa(int(entry.age(now).Seconds())))
+	header.Set(CacheStatusHeader, cacheStatus)
+	if entry.Status == http.StatusOK && matchesConditions(r, entry.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if entry.Status != http.StatusNoContent {
+		header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	}
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		_, err := w.Write(entry.Body)
+		if err != nil {
+			fmt.Println("Error writing cached response:", err)
+		}
+	}
+}
+
+// matchesConditions is true when the client already has the stored response.
+// If-Modified-Since only counts without If-None-Match.
+func matchesConditions(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || etag != "" && strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// cacheWriter passes the response of a backend on to the client and keeps a copy of it for the cache.
+// A 304 to the validators of a stored entry is held back, the client gets the entry instead.
+type cacheWriter struct {
+	http.ResponseWriter
+	header       http.Header
+	revalidating bool
+	maxBytes     int
+	wroteHeader  bool
+	notModified  bool
+	status       int
+	body         bytes.Buffer
+	// false once the response turns out not to be storable, too large or not fully sent
+	keep bool
+}
+
+func newCacheWriter(w http.ResponseWriter, revalidating bool, maxBytes int) *cacheWriter {
+	return &cacheWriter{ResponseWriter: w, header: make(http.Header), revalidating: revalidating, maxBytes: maxBytes}
+}
+
+func (w *cacheWriter) Header() http.Header {
+	// trailers are set on the header after the body
+	if w.wroteHeader && !w.notModified {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	// informational responses are dropped, the stored response could not repeat them
+	if w.wroteHeader || status < http.StatusOK {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if status == http.StatusNotModified && w.revalidating {
+		w.notModified = true
+		return
+	}
+	_, _, w.keep = responseFreshness(status, w.header, time.Now())
+	for key, values := range w.header {
+		for _, value := range values {
+			w.ResponseWriter.Header().Add(key, value)
+		}
+	}
+	w.ResponseWriter.Header().Set(CacheStatusHeader, "MISS")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return len(b), nil
+	}
+	if w.keep && w.body.Len()+len(b) > w.maxBytes {
+		w.keep = false
+		w.body = bytes.Buffer{}
+	}
+	if w.keep {
+		w.body.Write(b)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.keep = false
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && !w.notModified {
+		flusher.Flush()
+	}
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// entry returns the response as a cache entry, or nil when it cannot be stored
+func (w *cacheWriter) entry(now time.Time) *cacheEntry {
+	if !w.keep || w.notModified {
+		return nil
+	}
+	if length := w.header.Get("Content-Length"); length != "" && length != strconv.Itoa(w.body.Len()) {
+		return nil
+	}
+	fresh, staleWhileRevalidate, ok := responseFreshness(w.status, w.header, now)
+	if !ok {
+		return nil
+	}
+	return &cacheEntry{
+		Status:               w.status,
+		Header:               w.header.Clone(),
+		Body:                 w.body.Bytes(),
+		StoredAt:             now,
+		InitialAge:           headerAge(w.header),
+		FreshFor:             fresh,
+		StaleWhileRevalidate: staleWhileRevalidate,
+	}
+}
+
+// discardWriter takes the response of a revalidation nobody waits for
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w discardWriter) WriteHeader(int) {}
+
+// purgeCaches drops the stored responses of a service, or of every service when serviceName is empty.
+// host, path and prefix narrow down the responses, path and prefix are matched without the query.
+func purgeCaches(serviceName string, host string, path string, prefix string) int {
+	mux.Lock()
+	var caches []*httpCache
+	for _, s := range allServices() {
+		if s.cache != nil && (serviceName == "" || s.service.Name == serviceName) {
+			caches = append(caches, s.cache)
+		}
+	}
+	mux.Unlock()
+	host = strings.ToLower(host)
+	purged := 0
+	for _, c := range caches {
+		purged += c.remove(func(key string) bool {
+			keyHost, keyPath := splitCacheKey(key)
+			return (host == "" || keyHost == host) && (path == "" || keyPath == path) && strings.HasPrefix(keyPath, prefix)
+		})
+	}
+	return purged
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response. An entry for a response with a Vary header is stored under
+// the key of its variant, with a marker entry under the base key naming the headers it varies on.
+type cacheEntry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte
+	// when the entry was stored or last revalidated, and the Age the backend gave it then
+	StoredAt   time.Time
+	InitialAge time.Duration
+	FreshFor   time.Duration
+	// how long after going stale the entry can still be served while it is revalidated
+	StaleWhileRevalidate time.Duration
+	// set on marker entries
+	Vary []string
+}
+
+func (e *cacheEntry) isMarker() bool {
+	return len(e.Vary) > 0
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.StoredAt)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.FreshFor
+}
+
+func (e *cacheEntry) servableStale(now time.Time) bool {
+	return e.age(now) < e.FreshFor+e.StaleWhileRevalidate
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for name, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	for _, name := range e.Vary {
+		size += int64(len(name))
+	}
+	return size
+}
+
+// memoryTier keeps the most recently used entries up to a total size
+type memoryTier struct {
+	maxBytes int64
+	bytes    int64
+	items    map[string]*list.Element
+	lru      *list.List
+}
+
+func newMemoryTier(maxBytes int64) *memoryTier {
+	return &memoryTier{maxBytes: maxBytes, items: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (t *memoryTier) get(key string) *cacheEntry {
+	elem, ok := t.items[key]
+	if !ok {
+		return nil
+	}
+	t.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+func (t *memoryTier) put(entry *cacheEntry) {
+	t.remove(entry.Key)
+	t.items[entry.Key] = t.lru.PushFront(entry)
+	t.bytes += entry.size()
+	for t.bytes > t.maxBytes && t.lru.Len() > 0 {
+		t.remove(t.lru.Back().Value.(*cacheEntry).Key)
+	}
+}
+
+func (t *memoryTier) remove(key string) bool {
+	elem, ok := t.items[key]
+	if !ok {
+		return false
+	}
+	t.lru.Remove(elem)
+	delete(t.items, key)
+	t.bytes -= elem.Value.(*cacheEntry).size()
+	return true
+}
+
+// diskTier keeps entries that no longer fit in memory in files, one per entry. The files are only
+// an extension of the memory, the directory is emptied when the cache is created.
+type diskTier struct {
+	dir      string
+	maxBytes int64
+	lock     sync.Mutex
+	bytes    int64
+	items    map[string]*list.Element
+	lru      *list.List
+	closed   bool
+}
+
+type diskItem struct {
+	key  string
+	size int64
+}
+
+func newDiskTier(dir string, maxBytes int64) (*diskTier, error) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return &diskTier{dir: dir, maxBytes: maxBytes, items: make(map[string]*list.Element), lru: list.New()}, nil
+}
+
+func (t *diskTier) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(t.dir, hex.EncodeToString(sum[:]))
+}
+
+func (t *diskTier) get(key string) *cacheEntry {
+	t.lock.Lock()
+	elem, ok := t.items[key]
+	if ok {
+		t.lru.MoveToFront(elem)
+	}
+	t.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(t.file(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var entry cacheEntry
+	err = gob.NewDecoder(f).Decode(&entry)
+	if err != nil || entry.Key != key {
+		return nil
+	}
+	return &entry
+}
+
+// put writes the entry through a temporary file, so a reader never sees half of it
+func (t *diskTier) put(entry *cacheEntry) {
+	tmp, err := os.CreateTemp(t.dir, ".tmp-*")
+	if err != nil {
+		fmt.Println("Error writing cache entry:", err)
+		return
+	}
+	err = gob.NewEncoder(tmp).Encode(entry)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Println("Error writing cache entry:", err)
+		return
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		os.Remove(tmp.Name())
+		return
+	}
+	err = os.Rename(tmp.Name(), t.file(entry.Key))
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Println("Error writing cache entry:", err)
+		return
+	}
+	t.forget(entry.Key)
+	t.items[entry.Key] = t.lru.PushFront(&diskItem{key: entry.Key, size: info.Size()})
+	t.bytes += info.Size()
+	for t.bytes > t.maxBytes && t.lru.Len() > 0 {
+		t.removeLocked(t.lru.Back().Value.(*diskItem).key)
+	}
+}
+
+func (t *diskTier) remove(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.removeLocked(key)
+}
+
+func (t *diskTier) removeLocked(key string) bool {
+	if !t.forget(key) {
+		return false
+	}
+	os.Remove(t.file(key))
+	return true
+}
+
+// forget drops the key from the index and keeps the file, which is about to be replaced
+func (t *diskTier) forget(key string) bool {
+	elem, ok := t.items[key]
+	if !ok {
+		return false
+	}
+	t.lru.Remove(elem)
+	delete(t.items, key)
+	t.bytes -= elem.Value.(*diskItem).size
+	return true
+}
+
+func (t *diskTier) keys() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	keys := make([]string, 0, len(t.items))
+	for key := range t.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (t *diskTier) size() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.bytes
+}
+
+// close stops writes from fetches still running against a cache that was replaced
+func (t *diskTier) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+}
+
+// cacheBaseKey is the scheme, the host and the URI the client asked for, the variants of a response start with it.
+// A response to a plain HTTP request, such as a redirect to https, is never served to a TLS client.
+func cacheBaseKey(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	return forwardedProto(r) + "://" + host + r.URL.RequestURI() + "\n"
+}
+
+// variantKey adds the values of the headers the response varies on to the base key
+func variantKey(baseKey string, vary []string, r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(baseKey)
+	for _, name := range vary {
+		key.WriteString(name)
+		key.WriteByte(':')
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+		key.WriteByte('\n')
+	}
+	return key.String()
+}
+
+// splitCacheKey returns the host and the path of a key, for purging. A purge drops the responses of both schemes.
+func splitCacheKey(key string) (string, string) {
+	uri := key
+	if i := strings.IndexByte(key, '\n'); i >= 0 {
+		uri = key[:i]
+	}
+	if i := strings.Index(uri, "://"); i >= 0 {
+		uri = uri[i+len("://"):]
+	}
+	host, path := uri, "/"
+	if i := strings.IndexByte(uri, '/'); i >= 0 {
+		host, path = uri[:i], uri[i:]
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return host, path
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+
+	defaultCircuitConsecutiveFailures = 10
+	defaultCircuitErrorRatePercent    = 50
+	defaultCircuitMinRequests         = 20
+	defaultCircuitOpenSeconds         = 10
+	defaultCircuitHalfOpenRequests    = 3
+
+	circuitWindow = 10 * time.Second
+)
+
+type circuitConfig struct {
+	consecutiveFailures int
+	errorRatePercent    int
+	minRequests         int
+	openDuration        time.Duration
+	halfOpenRequests    int
+}
+
+func getCircuitConfig(service *Service) circuitConfig {
+	config := circuitConfig{
+		consecutiveFailures: service.CircuitConsecutiveFailures,
+		errorRatePercent:    service.CircuitErrorRatePercent,
+		minRequests:         service.CircuitMinRequests,
+		openDuration:        time.Duration(service.CircuitOpenSeconds) * time.Second,
+		halfOpenRequests:    service.CircuitHalfOpenRequests,
+	}
+	if config.consecutiveFailures <= 0 {
+		config.consecutiveFailures = defaultCircuitConsecutiveFailures
+	}
+	if config.errorRatePercent <= 0 {
+		config.errorRatePercent = defaultCircuitErrorRatePercent
+	}
+	if config.minRequests <= 0 {
+		config.minRequests = defaultCircuitMinRequests
+	}
+	if config.openDuration <= 0 {
+		config.openDuration = defaultCircuitOpenSeconds * time.Second
+	}
+	if config.halfOpenRequests <= 0 {
+		config.halfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+	return config
+}
+
+// circuitBreaker stops traffic to a backend once it trips on consecutive failures or on its error rate.
+// After openDuration it lets halfOpenRequests trial requests through, closing again when all of them succeed.
+type circuitBreaker struct {
+	lock                sync.Mutex
+	state               string
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+	openedAt            time.Time
+	halfOpenInFlight    int
+	halfOpenSuccesses   int
+}
+
+type CircuitBreakerStatus struct {
+	ContainerName       string     `json:"containerName"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	WindowRequests      int        `json:"windowRequests"`
+	WindowFailures      int        `json:"windowFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+}
+
+func (c *circuitBreaker) currentState(now time.Time, config circuitConfig) string {
+	switch c.state {
+	case CircuitOpen:
+		if now.Sub(c.openedAt) >= config.openDuration {
+			return CircuitHalfOpen
+		}
+		return CircuitOpen
+	case CircuitHalfOpen:
+		return CircuitHalfOpen
+	default:
+		return CircuitClosed
+	}
+}
+
+func (c *circuitBreaker) allow(now time.Time, config circuitConfig) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.currentState(now, config) {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return c.state == CircuitOpen || c.halfOpenInFlight < config.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+func (c *circuitBreaker) picked(now time.Time, config circuitConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.currentState(now, config) != CircuitHalfOpen {
+		return
+	}
+	if c.state == CircuitOpen {
+		c.state = CircuitHalfOpen
+		c.halfOpenInFlight = 0
+		c.halfOpenSuccesses = 0
+	}
+	c.halfOpenInFlight++
+}
+
+// release gives back a half-open slot of a request that ended without a result, like a cancelled one
+func (c *circuitBreaker) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == CircuitHalfOpen && c.halfOpenInFlight > 0 {
+		c.halfOpenInFlight--
+	}
+}
+
+func (c *circuitBreaker) record(backend *BackendServer, success bool, config circuitConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	switch c.state {
+	case CircuitOpen:
+		// late results of requests sent before the circuit opened
+		return
+	case CircuitHalfOpen:
+		if c.halfOpenInFlight > 0 {
+			c.halfOpenInFlight--
+		}
+		if !success {
+			c.trip(backend, now)
+			return
+		}
+		c.halfOpenSuccesses++
+		if c.halfOpenSuccesses >= config.halfOpenRequests {
+			fmt.Println("Closing circuit of backend", backend.ContainerName)
+			c.state = CircuitClosed
+			c.consecutiveFailures = 0
+			c.windowStart = now
+			c.windowRequests = 0
+			c.windowFailures = 0
+		}
+		return
+	}
+	if now.Sub(c.windowStart) >= circuitWindow {
+		c.windowStart = now
+		c.windowRequests = 0
+		c.windowFailures = 0
+	}
+	c.windowRequests++
+	if success {
+		c.consecutiveFailures = 0
+		return
+	}
+	c.consecutiveFailures++
+	c.windowFailures++
+	if c.consecutiveFailures >= config.consecutiveFailures ||
+		(c.windowRequests >= config.minRequests && c.windowFailures*100 >= c.windowRequests*config.errorRatePercent) {
+		c.trip(backend, now)
+	}
+}
+
+func (c *circuitBreaker) trip(backend *BackendServer, now time.Time) {
+	fmt.Println("Opening circuit of backend", backend.ContainerName)
+	c.state = CircuitOpen
+	c.openedAt = now
+	c.halfOpenInFlight = 0
+	c.halfOpenSuccesses = 0
+}
+
+func (c *circuitBreaker) status(backend *BackendServer, now time.Time, config circuitConfig) CircuitBreakerStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	status := CircuitBreakerStatus{
+		ContainerName:       backend.ContainerName,
+		State:               c.currentState(now, config),
+		ConsecutiveFailures: c.consecutiveFailures,
+		WindowRequests:      c.windowRequests,
+		WindowFailures:      c.windowFailures,
+	}
+	if status.State != CircuitClosed {
+		openedAt := c.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+func getCircuitBreakerStatuses() []CircuitBreakerStatus {
+	mux.Lock()
+	defer mux.Unlock()
+	now := time.Now()
+	var statuses []CircuitBreakerStatus
+	for _, s := range allServices() {
+		config := getCircuitConfig(&s.service)
+		for _, backend := range s.service.Backends {
+			statuses = append(statuses, backend.breaker.status(backend, now, config))
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priority classes, a request without a known class is normal
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var priorityClasses = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+const (
+	defaultPriorityHeader          = "X-Priority"
+	defaultConcurrencyQueueTimeout = 1000
+
+	// the adaptive limit starts here and never goes below minAdaptiveLimit
+	initialAdaptiveLimit = 20
+	minAdaptiveLimit     = 2
+	// without a max-in-flight the adaptive limit stops growing here
+	maxAdaptiveLimit = 1000
+	// a request taking longer than this many times the lowest latency seen counts as congestion
+	adaptiveLatencyTolerance = 2.0
+	adaptiveBackoffRatio     = 0.9
+	// the lowest latency is forgotten after a while, so a service that became slower for good gets a new baseline
+	adaptiveLatencyWindow = 30 * time.Second
+)
+
+type concurrencyConfig struct {
+	maxInFlight    int
+	adaptive       bool
+	queueSize      int
+	queueTimeout   time.Duration
+	priorityHeader string
+}
+
+func getConcurrencyConfig(service *Service) concurrencyConfig {
+	config := concurrencyConfig{
+		maxInFlight:    service.MaxInFlight,
+		adaptive:       service.AdaptiveConcurrency,
+		queueSize:      service.ConcurrencyQueueSize,
+		queueTimeout:   time.Duration(service.ConcurrencyQueueTimeoutMs) * time.Millisecond,
+		priorityHeader: service.PriorityHeader,
+	}
+	if config.queueTimeout <= 0 {
+		config.queueTimeout = defaultConcurrencyQueueTimeout * time.Millisecond
+	}
+	if config.priorityHeader == "" {
+		config.priorityHeader = defaultPriorityHeader
+	}
+	return config
+}
+
+// concurrencyLimiter caps the requests in flight to a service. The limit is the max-in-flight of the service,
+// or in adaptive mode a limit that grows by one per round trip while latency stays low
+// and shrinks by a tenth whenever latency climbs or the backends fail (AIMD).
+// Requests over the limit wait in a bounded queue that lets high priority requests out first,
+// low priority requests only get the first half of the queue so they are shed first.
+type concurrencyLimiter struct {
+	config   concurrencyConfig
+	lock     sync.Mutex
+	limit    float64
+	maxLimit float64
+	inFlight int
+	// waiting requests by priority class, in the order of priorityClasses
+	queues  [3][]*concurrencyWaiter
+	waiting int
+
+	minLatency   time.Duration
+	windowMin    time.Duration
+	windowStart  time.Time
+	lastDecrease time.Time
+}
+
+type concurrencyWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// newConcurrencyLimiter returns nil when the service sets no limit
+func newConcurrencyLimiter(service *Service) *concurrencyLimiter {
+	config := getConcurrencyConfig(service)
+	if config.maxInFlight <= 0 && !config.adaptive {
+		return nil
+	}
+	l := &concurrencyLimiter{config: config, maxLimit: maxAdaptiveLimit}
+	if config.maxInFlight > 0 {
+		l.maxLimit = float64(config.maxInFlight)
+	}
+	l.limit = l.maxLimit
+	if config.adaptive {
+		l.limit = math.Min(initialAdaptiveLimit, l.maxLimit)
+	}
+	return l
+}
+
+func (l *concurrencyLimiter) priorityOf(r *http.Request) int {
+	value := strings.ToLower(r.Header.Get(l.config.priorityHeader))
+	for i, class := range priorityClasses {
+		if value == class {
+			return i
+		}
+	}
+	return 1
+}
+
+// queueCapacity is how many requests may wait before a request of the priority is shed
+func (l *concurrencyLimiter) queueCapacity(priority int) int {
+	if priorityClasses[priority] == PriorityLow {
+		return l.config.queueSize / 2
+	}
+	return l.config.queueSize
+}
+
+// acquire takes a slot for the request, waiting in the queue for at most the queue timeout.
+// It returns false when the request is shed.
+func (l *concurrencyLimiter) acquire(ctx context.Context, priority int) bool {
+	l.lock.Lock()
+	if l.inFlight < int(l.limit) && l.waitingBefore(priority) == 0 {
+		l.inFlight++
+		l.lock.Unlock()
+		return true
+	}
+	if l.waiting >= l.queueCapacity(priority) {
+		l.lock.Unlock()
+		return false
+	}
+	waiter := &concurrencyWaiter{ready: make(chan struct{})}
+	l.queues[priority] = append(l.queues[priority], waiter)
+	l.waiting++
+	l.lock.Unlock()
+
+	timer := time.NewTimer(l.config.queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if waiter.granted {
+		// the slot was handed over while the wait ran out, give it to the next one
+		l.inFlight--
+		l.grant()
+		return false
+	}
+	for i, w := range l.queues[priority] {
+		if w == waiter {
+			l.queues[priority] = append(l.queues[priority][:i], l.queues[priority][i+1:]...)
+			l.waiting--
+			break
+		}
+	}
+	return false
+}
+
+// waitingBefore counts the queued requests that go before a new request of the priority
+func (l *concurrencyLimiter) waitingBefore(priority int) int {
+	count := 0
+	for i := 0; i <= priority; i++ {
+		count += len(l.queues[i])
+	}
+	return count
+}
+
+// release frees the slot of a request and feeds its latency into the adaptive limit
+func (l *concurrencyLimiter) release(latency time.Duration, failed bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inFlight--
+	if l.config.adaptive {
+		l.adapt(latency, failed, time.Now())
+	}
+	l.grant()
+}
+
+// grant hands free slots to the waiting requests, highest priority first. lock must be held.
+func (l *concurrencyLimiter) grant() {
+	for l.inFlight < int(l.limit) && l.waiting > 0 {
+		for i := range l.queues {
+			if len(l.queues[i]) == 0 {
+				continue
+			}
+			waiter := l.queues[i][0]
+			l.queues[i] = l.queues[i][1:]
+			l.waiting--
+			l.inFlight++
+			waiter.granted = true
+			close(waiter.ready)
+			break
+		}
+	}
+}
+
+// adapt moves the limit after a request ended. lock must be held.
+func (l *concurrencyLimiter) adapt(latency time.Duration, failed bool, now time.Time) {
+	if l.windowMin == 0 || latency < l.windowMin {
+		l.windowMin = latency
+	}
+	if now.Sub(l.windowStart) >= adaptiveLatencyWindow {
+		l.minLatency = l.windowMin
+		l.windowMin = latency
+		l.windowStart = now
+	}
+	baseline := l.windowMin
+	if l.minLatency > 0 && l.minLatency < baseline {
+		baseline = l.minLatency
+	}
+	congested := failed || float64(latency) > float64(baseline)*adaptiveLatencyTolerance
+	if congested {
+		// the requests that were in flight together all see the same congestion, back off once per round trip
+		if now.Sub(l.lastDecrease) >= latency {
+			l.limit = math.Max(minAdaptiveLimit, l.limit*adaptiveBackoffRatio)
+			l.lastDecrease = now
+		}
+		return
+	}
+	// only grow a limit that is being used, an idle service says nothing about how much it can take
+	if float64(l.inFlight+1) >= l.limit/2 {
+		l.limit = math.Min(l.maxLimit, l.limit+1/l.limit)
+	}
+}
+
+// currentLimit returns the limit and the number of waiting requests
+func (l *concurrencyLimiter) currentLimit() (int, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.limit), l.waiting
+}
+
+// acquireConcurrency waits for a slot of the service, answering 503 when the request is shed.
+// The returned release has to be called with the time the backend took to respond.
+func (s *balancedService) acquireConcurrency(w http.ResponseWriter, r *http.Request, serviceName string) (func(time.Duration, bool), bool) {
+	mux.Lock()
+	limiter := s.concurrency
+	mux.Unlock()
+	if limiter == nil {
+		return func(time.Duration, bool) {}, true
+	}
+	priority := limiter.priorityOf(r)
+	if !limiter.acquire(r.Context(), priority) {
+		requestsShedTotal.WithLabelValues(serviceName, priorityClasses[priority]).Inc()
+		writeError(w, r, http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return limiter.release, true
+}
@@ -1,18 +0,0 @@
-package main
-
-import (
-	"fmt"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
-)
-
-func getDb() *gorm.DB {
-	dsn := "host=host.docker.internal user=shreyambesh password=postgres dbname=load_balancer port=5432 sslmode=disable"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
-	}
-
-	fmt.Println("Connected to database")
-	return db
-}
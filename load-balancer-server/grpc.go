@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// protocols a service can speak, the balancer treats a service without one as HTTP
+const (
+	ProtocolHTTP = "http"
+	ProtocolGRPC = "grpc"
+)
+
+// the gRPC status codes the balancer looks at
+const (
+	grpcStatusUnknown          = 2
+	grpcStatusDeadlineExceeded = 4
+	grpcStatusPermissionDenied = 7
+	grpcStatusUnimplemented    = 12
+	grpcStatusInternal         = 13
+	grpcStatusUnavailable      = 14
+	grpcStatusDataLoss         = 15
+	grpcStatusUnauthenticated  = 16
+)
+
+const defaultRetryOnGRPCStatus = "14"
+
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatusFailure tells whether a call failed because of the backend rather than because of the call itself
+func grpcStatusFailure(code int) bool {
+	switch code {
+	case grpcStatusDeadlineExceeded, grpcStatusInternal, grpcStatusUnavailable, grpcStatusDataLoss:
+		return true
+	}
+	return false
+}
+
+// grpcStatusOf reads the status of a call from its trailers, or from its headers for a trailers-only response
+func grpcStatusOf(header http.Header) (int, bool) {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return grpcStatusUnknown, true
+	}
+	return code, true
+}
+
+// reportGRPCResponse feeds the result of a call into the outlier detection and the circuit breaker.
+// Every call is its own HTTP/2 stream and is balanced on its own, its status is only known at the end of the stream.
+func reportGRPCResponse(s *balancedService, resp *http.Response, backend *BackendServer) {
+	if resp.StatusCode != http.StatusOK {
+		s.reportUpstreamResult(backend, resp.StatusCode < 500)
+		return
+	}
+	if code, ok := grpcStatusOf(resp.Header); ok {
+		s.reportUpstreamResult(backend, !grpcStatusFailure(code))
+		return
+	}
+	resp.Body = &grpcResponseBody{ReadCloser: resp.Body, resp: resp, service: s, backend: backend}
+}
+
+// grpcResponseBody reports the status of a call once its trailers arrived with the end of the body
+type grpcResponseBody struct {
+	io.ReadCloser
+	resp     *http.Response
+	service  *balancedService
+	backend  *BackendServer
+	reported bool
+}
+
+func (b *grpcResponseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == nil || b.reported {
+		return n, err
+	}
+	b.reported = true
+	switch {
+	case err == io.EOF:
+		code, ok := grpcStatusOf(b.resp.Trailer)
+		// a stream without a status was cut short by the backend
+		b.service.reportUpstreamResult(b.backend, ok && !grpcStatusFailure(code))
+	case errors.Is(err, context.Canceled):
+		releaseUpstream(b.backend)
+	default:
+		b.service.reportUpstreamResult(b.backend, false)
+	}
+	return n, err
+}
+
+func (b *grpcResponseBody) Close() error {
+	if !b.reported {
+		// the client went away before the call ended
+		b.reported = true
+		releaseUpstream(b.backend)
+	}
+	return b.ReadCloser.Close()
+}
+
+// grpcStatusForHTTP maps the status of an error of the balancer the way gRPC clients map HTTP statuses
+func grpcStatusForHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcStatusInternal
+	case http.StatusUnauthorized:
+		return grpcStatusUnauthenticated
+	case http.StatusForbidden:
+		return grpcStatusPermissionDenied
+	case http.StatusNotFound:
+		return grpcStatusUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcStatusUnavailable
+	}
+	return grpcStatusUnknown
+}
+
+// writeGRPCError ends a call with a trailers-only response, gRPC clients take the status from the headers
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes the message as the gRPC protocol asks for
+func encodeGRPCMessage(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			encoded.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&encoded, "%%%02X", c)
+	}
+	return encoded.String()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	HashKeyClientIP = "client-ip"
+	HashKeyHeader   = "header"
+	HashKeyCookie   = "cookie"
+)
+
+// number of points every backend of weight 1 gets on the ring
+const virtualNodesPerBackend = 160
+
+// consistentHash pins a key to a backend using a hash ring with virtual nodes,
+// so a backend joining or leaving only remaps the keys of its own points.
+// The ring holds every backend of the service, the points of unavailable backends are passed over.
+type consistentHash struct {
+	ring []uint32
+	// container name of the backend at each point
+	owners   map[uint32]string
+	members  string
+	fallback roundRobin
+}
+
+// Next walks the ring clockwise from the key to the first point of an available backend, the keys
+// of a backend that is unavailable for a while go to the next points and come back after
+func (s *consistentHash) Next(backends []*BackendServer, key string) *BackendServer {
+	if key == "" || len(s.ring) == 0 {
+		return s.fallback.Next(backends, key)
+	}
+	available := make(map[string]*BackendServer, len(backends))
+	for _, backend := range backends {
+		available[backend.ContainerName] = backend
+	}
+	hash := hashOf(key)
+	start := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i] >= hash
+	})
+	for i := 0; i < len(s.ring); i++ {
+		if backend, ok := available[s.owners[s.ring[(start+i)%len(s.ring)]]]; ok {
+			return backend
+		}
+	}
+	// none of the backends on the ring is available
+	return s.fallback.Next(backends, key)
+}
+
+// setMembers rebuilds the ring only when the backends of the service or their weights changed since the last call
+func (s *consistentHash) setMembers(backends []*BackendServer) {
+	names := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		names = append(names, fmt.Sprintf("%s*%d", backend.ContainerName, backend.weight()))
+	}
+	sort.Strings(names)
+	members := strings.Join(names, ",")
+	if members == s.members {
+		return
+	}
+	s.members = members
+	s.ring = s.ring[:0]
+	s.owners = make(map[uint32]string)
+	for _, backend := range backends {
+		for i := 0; i < virtualNodesPerBackend*backend.weight(); i++ {
+			point := hashOf(fmt.Sprintf("%s#%d", backend.ContainerName, i))
+			if _, taken := s.owners[point]; taken {
+				continue
+			}
+			s.owners[point] = backend.ContainerName
+			s.ring = append(s.ring, point)
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		return s.ring[i] < s.ring[j]
+	})
+}
+
+// hashOf is fnv-1a followed by the murmur3 finalizer, fnv alone clusters the
+// points of names that only differ in their last characters
+func hashOf(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	hash := h.Sum32()
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
+
+// requestHashKey extracts the affinity key configured on the service from the request
+func requestHashKey(r *http.Request, service *Service) string {
+	switch service.HashKeySource {
+	case HashKeyHeader:
+		return r.Header.Get(service.HashKeyName)
+	case HashKeyCookie:
+		cookie, err := r.Cookie(service.HashKeyName)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	default:
+		return clientIP(r)
+	}
+}
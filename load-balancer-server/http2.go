@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/net/http2"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHTTP2MaxConcurrentStreams = 250
+	defaultHTTP2IdleTimeout          = 120
+
+	// an upstream connection without frames for this long is pinged, and closed when the ping is not answered
+	upstreamHTTP2ReadIdleTimeout = 30 * time.Second
+	upstreamHTTP2PingTimeout     = 15 * time.Second
+)
+
+// newHTTP2Server holds the multiplexing settings for client connections, shared by the TLS and h2c listeners.
+// HTTP2_MAX_CONCURRENT_STREAMS limits the requests in flight on one connection.
+func newHTTP2Server() *http2.Server {
+	maxConcurrentStreams, err := strconv.Atoi(os.Getenv("HTTP2_MAX_CONCURRENT_STREAMS"))
+	if err != nil || maxConcurrentStreams <= 0 {
+		maxConcurrentStreams = defaultHTTP2MaxConcurrentStreams
+	}
+	return &http2.Server{
+		MaxConcurrentStreams: uint32(maxConcurrentStreams),
+		IdleTimeout:          envSeconds("HTTP2_IDLE_TIMEOUT", defaultHTTP2IdleTimeout),
+	}
+}
+
+// upstreamHTTP2Transport speaks HTTP/2 to the backends, many requests share one connection per backend.
+// TLS backends negotiate it, plain backends are expected to accept h2c with prior knowledge.
+func upstreamHTTP2Transport(transport *http.Transport, upstreamTLS bool) http.RoundTripper {
+	if upstreamTLS {
+		h2Transport, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			log.Printf("Error configuring HTTP/2 to the backends: %s", err)
+			return transport
+		}
+		h2Transport.ReadIdleTimeout = upstreamHTTP2ReadIdleTimeout
+		h2Transport.PingTimeout = upstreamHTTP2PingTimeout
+		transport.ForceAttemptHTTP2 = true
+		return transport
+	}
+	h2cTransport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+			return transport.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: upstreamHTTP2ReadIdleTimeout,
+		PingTimeout:     upstreamHTTP2PingTimeout,
+	}
+	return &responseHeaderTimeout{next: h2cTransport, timeout: transport.ResponseHeaderTimeout}
+}
+
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// responseHeaderTimeout gives the h2c transport the upstream timeout the HTTP/1.1 transport has built in,
+// the response body can take as long as it needs
+type responseHeaderTimeout struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *responseHeaderTimeout) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+	resp, err := t.next.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		// not context.Canceled, the backend is at fault and not the client
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"gorm.io/gorm"
+	"github.com/google/uuid"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +27,11 @@ type IncomingReq struct {
 	reqId   string
 }
 
+const RequestIDHeader = "X-Request-ID"
+
+// incoming request ids longer than this are replaced instead of being forwarded
+const maxRequestIDLength = 128
+
 type BackendServer struct {
 	ID             uint `json:"id"`
 	ServiceID      uint
@@ -26,12 +40,17 @@ type BackendServer struct {
 	Port           int    `json:"port"`
 	unHealthyCount int
 	ContainerName  string `json:"containerName"`
-	numRequests    int
+	Weight         int    `json:"weight"`
+	IsDraining     bool   `json:"isDraining"`
+	numRequests    int64
+	activeRequests int64
+	outlier        outlierDetector
+	breaker        circuitBreaker
 }
 
 type Service struct {
 	ID                  uint             `json:"id"`
-	Name                string           `json:"name" gorm:"unique"`
+	Name                string           `json:"name"`
 	Backends            []*BackendServer `json:"backends"`
 	HealthEndpoint      string           `json:"healthEndpoint"`
 	UnHealthyThreshold  int              `json:"unHealthyThreshold"`
@@ -40,129 +59,583 @@ type Service struct {
 	Max                 int              `json:"max"`
 	ContainerImageName  string           `json:"containerImageName"`
 	ContainerPort       int              `json:"containerPort"`
+	Strategy            string           `json:"strategy"`
+	HashKeySource       string           `json:"hashKeySource"`
+	HashKeyName         string           `json:"hashKeyName"`
+	UpstreamTimeout     int              `json:"upstreamTimeout"`
+	UpstreamTLS         bool             `json:"upstreamTls"`
+	UpstreamHTTP2       bool             `json:"upstreamHttp2"`
+	Protocol            string           `json:"protocol"`
+	TCPIdleTimeout      int              `json:"tcpIdleTimeout"`
+	UDPIdleTimeout      int              `json:"udpIdleTimeout"`
+
+	OutlierConsecutiveFailures int `json:"outlierConsecutiveFailures"`
+	OutlierErrorRatePercent    int `json:"outlierErrorRatePercent"`
+	OutlierBaseEjectionSeconds int `json:"outlierBaseEjectionSeconds"`
+	OutlierMaxEjectionPercent  int `json:"outlierMaxEjectionPercent"`
+
+	RetryMaxAttempts   int    `json:"retryMaxAttempts"`
+	RetryOnStatus      string `json:"retryOnStatus"`
+	RetryNonIdempotent bool   `json:"retryNonIdempotent"`
+	RetryBudgetPercent int    `json:"retryBudgetPercent"`
+	RetryOnGRPCStatus  string `json:"retryOnGrpcStatus"`
+
+	CircuitConsecutiveFailures int `json:"circuitConsecutiveFailures"`
+	CircuitErrorRatePercent    int `json:"circuitErrorRatePercent"`
+	CircuitMinRequests         int `json:"circuitMinRequests"`
+	CircuitOpenSeconds         int `json:"circuitOpenSeconds"`
+	CircuitHalfOpenRequests    int `json:"circuitHalfOpenRequests"`
+
+	AccessLogFormat     string  `json:"accessLogFormat"`
+	AccessLogFields     string  `json:"accessLogFields"`
+	AccessLogSampleRate float64 `json:"accessLogSampleRate"`
+	AccessLogLevel      string  `json:"accessLogLevel"`
+
+	Certificates []Certificate `json:"certificates"`
+	TLSRedirect  bool          `json:"tlsRedirect"`
+
+	Rewrite *RewriteRules `json:"rewrite"`
+
+	RateLimitPerSecond float64 `json:"rateLimitPerSecond"`
+	RateLimitBurst     int     `json:"rateLimitBurst"`
+	RateLimitKey       string  `json:"rateLimitKey"`
+	RateLimitHeader    string  `json:"rateLimitHeader"`
+	RateLimitGlobal    bool    `json:"rateLimitGlobal"`
+
+	MaxInFlight               int    `json:"maxInFlight"`
+	AdaptiveConcurrency       bool   `json:"adaptiveConcurrency"`
+	ConcurrencyQueueSize      int    `json:"concurrencyQueueSize"`
+	ConcurrencyQueueTimeoutMs int    `json:"concurrencyQueueTimeoutMs"`
+	PriorityHeader            string `json:"priorityHeader"`
+
+	CacheEnabled     bool   `json:"cacheEnabled"`
+	CacheMemoryMB    int    `json:"cacheMemoryMb"`
+	CacheMaxObjectKB int    `json:"cacheMaxObjectKb"`
+	CacheDiskDir     string `json:"cacheDiskDir"`
+	CacheDiskMB      int    `json:"cacheDiskMb"`
 }
 type ReverseProxy struct {
 	reverseProxy *httputil.ReverseProxy
 	origin       *url.URL
 }
 
-var reverseProxies = make(map[string]ReverseProxy)
+type contextKey string
+
+// the backend a request is proxied to, read back by the reverse proxy hooks
+const backendContextKey = contextKey("backend")
+
+// the IncomingReq of the client request
+const incomingReqContextKey = contextKey("incomingReq")
 
-var requestLog []time.Time
+// the rewriters of the route and the service of a request, in the order they run
+const rewritersContextKey = contextKey("rewriters")
+
+const defaultUpstreamTimeout = 30
 
 func (b *BackendServer) String() string {
 	return fmt.Sprintf("%s:%d", b.Host, b.Port)
 }
 
-func addReverseProxy(service *Service, b *BackendServer) {
-	origin, err := url.Parse(fmt.Sprintf("http://%s:%d", b.ContainerName, service.ContainerPort))
+// update copies the stored fields of a freshly loaded backend while keeping the runtime counters
+func (b *BackendServer) update(from *BackendServer) {
+	b.ID = from.ID
+	b.ServiceID = from.ServiceID
+	b.Host = from.Host
+	b.IsHealthy = from.IsHealthy
+	b.Port = from.Port
+	b.ContainerName = from.ContainerName
+	b.Weight = from.Weight
+	b.IsDraining = from.IsDraining
+}
+
+func (s *balancedService) addReverseProxy(service *Service, b *BackendServer) {
+	scheme := "http"
+	var tlsConfig *tls.Config
+	if service.UpstreamTLS {
+		scheme = "https"
+		config, err := upstreamTLSConfig()
+		if err != nil {
+			// without the certificates the backends reject the connections and requests fail with a 502
+			log.Printf("Error loading upstream certificates: %s", err)
+		}
+		tlsConfig = config
+	}
+	origin, err := url.Parse(fmt.Sprintf("%s://%s:%d", scheme, b.ContainerName, service.ContainerPort))
 	if err != nil {
 		panic(err)
 	}
-	reverseProxies[b.ContainerName] = ReverseProxy{
-		reverseProxy: httputil.NewSingleHostReverseProxy(origin),
+	upstreamTimeout := service.UpstreamTimeout
+	if upstreamTimeout <= 0 {
+		upstreamTimeout = defaultUpstreamTimeout
+	}
+	reverseProxy := httputil.NewSingleHostReverseProxy(origin)
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: time.Duration(upstreamTimeout) * time.Second,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	reverseProxy.Transport = transport
+	grpc := service.Protocol == ProtocolGRPC
+	// gRPC needs HTTP/2 end to end
+	if service.UpstreamHTTP2 || grpc {
+		reverseProxy.Transport = upstreamHTTP2Transport(transport, service.UpstreamTLS)
+	}
+	director := reverseProxy.Director
+	reverseProxy.Director = func(r *http.Request) {
+		director(r)
+		rewriters, _ := r.Context().Value(rewritersContextKey).([]*rewriter)
+		for _, rw := range rewriters {
+			rw.rewriteRequest(r)
+		}
+	}
+	reverseProxy.ModifyResponse = func(resp *http.Response) error {
+		// the balancer already set the request id on the response
+		resp.Header.Del(RequestIDHeader)
+		rewriters, _ := resp.Request.Context().Value(rewritersContextKey).([]*rewriter)
+		for _, rw := range rewriters {
+			rw.rewriteResponse(resp)
+		}
+		backend, ok := resp.Request.Context().Value(backendContextKey).(*BackendServer)
+		if ok && grpc {
+			reportGRPCResponse(s, resp, backend)
+		} else if ok {
+			s.reportUpstreamResult(backend, resp.StatusCode < 500)
+		}
+		return nil
+	}
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Error proxying request to %s: %s", b.ContainerName, err)
+		// a client going away says nothing about the backend
+		backend, ok := r.Context().Value(backendContextKey).(*BackendServer)
+		if ok && errors.Is(err, context.Canceled) {
+			releaseUpstream(backend)
+		} else if ok {
+			upstreamErrorsTotal.WithLabelValues(service.Name, backend.ContainerName).Inc()
+			s.reportUpstreamResult(backend, false)
+			if rw, ok := w.(*retryWriter); ok {
+				rw.upstreamFailed = true
+			}
+		}
+		writeError(w, r, http.StatusBadGateway)
+	}
+	s.reverseProxies[b.ContainerName] = ReverseProxy{
+		reverseProxy: reverseProxy,
 		origin:       origin,
 	}
 }
 
-var nextBackendIndex int
+// accessLogConfig returns how the requests sent to the service are logged, the defaults until its definition arrived
+func (s *balancedService) accessLogConfig() *accessLogConfig {
+	mux.Lock()
+	defer mux.Unlock()
+	if s == nil || s.accessLog == nil {
+		return defaultAccessLog
+	}
+	return s.accessLog
+}
 
-var service Service
+func (s *balancedService) tlsRedirect() bool {
+	mux.Lock()
+	defer mux.Unlock()
+	return s != nil && s.service.TLSRedirect
+}
+
+func currentServiceName() string {
+	mux.Lock()
+	defer mux.Unlock()
+	return home.service.Name
+}
+
+func (s *balancedService) getReverseProxy(containerName string) *httputil.ReverseProxy {
+	mux.Lock()
+	defer mux.Unlock()
+	return s.reverseProxies[containerName].reverseProxy
+}
+
+// balancedService is a service the balancer sends requests to, with the runtime state it keeps for it.
+// Its fields are guarded by mux.
+type balancedService struct {
+	service        Service
+	strategy       Strategy
+	reverseProxies map[string]ReverseProxy
+	rewriter       *rewriter
+	limiter        *rateLimiter
+	concurrency    *concurrencyLimiter
+	cache          *httpCache
+	accessLog      *accessLogConfig
+	retries        retryBudget
+	// version of the service definition last applied from the orchestrator
+	version uint64
+}
+
+func newBalancedService() *balancedService {
+	return &balancedService{reverseProxies: make(map[string]ReverseProxy)}
+}
+
+// home is the service the balancer is run for, it gets the requests no route matches and the tcp and udp traffic
+var home = newBalancedService()
+
+// the other services routes send requests to, by name
+var routedServices = make(map[string]*balancedService)
+
+var defaultAccessLog = newAccessLogConfig(&Service{})
 
 var mux sync.Mutex
 
-func getService(db *gorm.DB) {
-	ServiceName := os.Getenv("SERVICE_NAME")
-	var localService Service
-	err := db.Preload("Backends").First(&localService, "name = ?", ServiceName).Error
-	if err != nil {
-		panic(err)
+// allServices returns home and the routed services. mux must be held.
+func allServices() []*balancedService {
+	all := make([]*balancedService, 0, len(routedServices)+1)
+	all = append(all, home)
+	for _, s := range routedServices {
+		all = append(all, s)
+	}
+	return all
+}
+
+// setService switches to a new definition of the service, keeping the runtime state of the backends
+// that are still part of it. mux must be held.
+func (s *balancedService) setService(localService Service) {
+	service := &s.service
+	if localService.UpstreamTimeout != service.UpstreamTimeout || localService.UpstreamTLS != service.UpstreamTLS ||
+		localService.UpstreamHTTP2 != service.UpstreamHTTP2 || localService.Protocol != service.Protocol {
+		// the transports are built from the service settings
+		s.reverseProxies = make(map[string]ReverseProxy)
+	}
+	known := make(map[string]*BackendServer, len(service.Backends))
+	for _, backend := range service.Backends {
+		known[backend.ContainerName] = backend
 	}
 	//compare the backend lists and update the reverse proxies
-	for _, backend := range localService.Backends {
-		if _, ok := reverseProxies[backend.ContainerName]; !ok {
-			addReverseProxy(&localService, backend)
+	current := make(map[string]bool, len(localService.Backends))
+	for i, backend := range localService.Backends {
+		current[backend.ContainerName] = true
+		if existing, ok := known[backend.ContainerName]; ok {
+			existing.update(backend)
+			localService.Backends[i] = existing
+		}
+		if _, ok := s.reverseProxies[backend.ContainerName]; !ok {
+			s.addReverseProxy(&localService, backend)
 		}
 
 	}
-	mux.Lock()
-	service = localService
-	mux.Unlock()
+	for containerName := range s.reverseProxies {
+		if !current[containerName] {
+			delete(s.reverseProxies, containerName)
+		}
+	}
+	for containerName := range known {
+		if !current[containerName] || localService.Name != service.Name {
+			forgetBackendMetrics(service.Name, containerName)
+		}
+	}
+	if s.strategy == nil || localService.Strategy != service.Strategy {
+		s.strategy = newStrategy(localService.Strategy)
+	}
+	if strategy, ok := s.strategy.(memberAware); ok {
+		strategy.setMembers(localService.Backends)
+	}
+	s.service = localService
+	s.rewriter = newRewriter(localService.Rewrite)
+	// backend updates keep the buckets
+	if s.limiter == nil || s.limiter.config != getRateLimitConfig(&localService) {
+		s.limiter = newRateLimiter(&localService)
+	}
+	// requests in flight release into the limiter they were let in by
+	if s.concurrency == nil || s.concurrency.config != getConcurrencyConfig(&localService) {
+		s.concurrency = newConcurrencyLimiter(&localService)
+	}
+	// backend updates keep what is cached
+	if s.cache == nil || !localService.CacheEnabled || s.cache.config != getCacheConfig(&localService) {
+		if s.cache != nil {
+			s.cache.close()
+		}
+		s.cache = newHTTPCache(&localService)
+	}
+	s.accessLog = newAccessLogConfig(&localService)
+	updateCertificates()
 }
 
-func getServiceJob(db *gorm.DB) {
-	ticker := time.NewTicker(5 * time.Second)
-	for {
-		select {
-		case <-ticker.C:
-			getService(db)
-		}
+// updateCertificates serves the certificates of every service, so routed hostnames get theirs too. mux must be held.
+func updateCertificates() {
+	var all []Certificate
+	for _, s := range allServices() {
+		all = append(all, s.service.Certificates...)
 	}
+	certificates.update(all)
 }
 
 func main() {
-	db := getDb()
-	getService(db)
-	go apis(db)
-	go getServiceJob(db)
+	defer initTracing()()
+	configFile := os.Getenv("SERVICE_CONFIG")
+	loaded := false
+	if configFile != "" {
+		loaded = loadServiceConfig(configFile)
+	}
+	if !loaded {
+		loaded = loadServiceCache()
+	}
+	if configFile != "" {
+		go reloadServiceConfigOnHangup(configFile)
+	}
+	proxyListener, err := listen("proxy", ":4000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsListener, err := listen("tls", ":4443")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tcpListener, err := listen("tcp", ":5000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	udpConn, err := listenPacket("udp", ":6000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	adminListener, err := listen("admin", ":3210")
+	if err != nil {
+		log.Fatal(err)
+	}
+	adminServer := apis(adminListener)
+	// a config file without an orchestrator runs the load balancer standalone
+	if configFile == "" || os.Getenv("ORCHESTRATOR_URL") != "" {
+		go serviceStreamJob(context.Background(), homeServiceName(), home)
+		// the services routed to at boot come from the config file or the cache
+		mux.Lock()
+		syncRoutedServiceStreams()
+		mux.Unlock()
+		go routesStreamJob()
+		go rateLimitSyncJob()
+		if !loaded {
+			waitForServiceUpdate(bootSnapshotTimeout)
+		}
+	}
+	go accessLogWriter()
 
-	// Start cleanup goroutine
+	h2Server := newHTTP2Server()
+	// plain connections can speak HTTP/2 too, either with prior knowledge or by upgrading
+	proxyServer := &http.Server{Handler: h2c.NewHandler(http.HandlerFunc(proxy), h2Server)}
+	go func() {
+		err := proxyServer.Serve(proxyListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	tlsServer := &http.Server{Handler: http.HandlerFunc(proxy), TLSConfig: newTLSConfig()}
+	err = http2.ConfigureServer(tlsServer, h2Server)
+	if err != nil {
+		log.Fatal(err)
+	}
 	go func() {
-		ticker := time.NewTicker(60 * time.Second)
-		for range ticker.C {
-			cleanupRequestLog()
+		// the certificates come from the service, not from files
+		err := tlsServer.ServeTLS(tlsListener, "", "")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
 		}
 	}()
-	http.HandleFunc("/", proxy)
-	log.Fatal(http.ListenAndServe(":4000", nil))
+	tcpProxy := serveTCP(tcpListener)
+	udpProxy := serveUDP(udpConn)
+	// the admin server stays up until the proxied requests are done, the orchestrator watches them drain
+	waitForShutdown(proxyServer, tlsServer, tcpProxy, udpProxy, adminServer)
 }
 
-// Round-robin return only healthy backend
-func getNextBackend() *BackendServer {
+// Return only healthy backend, picked by the balancing strategy of the service.
+// Backends in tried were already attempted for this request and are skipped.
+func (s *balancedService) getNextBackend(r *http.Request, tried map[string]bool) *BackendServer {
+	return s.pickBackend(tried, func(service *Service) string {
+		return requestHashKey(r, service)
+	})
+}
+
+// pickBackend is shared by every protocol, hashKey is only called when the service uses consistent hashing
+func (s *balancedService) pickBackend(tried map[string]bool, hashKey func(*Service) string) *BackendServer {
 	mux.Lock()
 	defer mux.Unlock()
-	backends := service.Backends
-	if len(backends) == 0 {
+	service := &s.service
+	now := time.Now()
+	circuitConfig := getCircuitConfig(service)
+	healthyBackends := make([]*BackendServer, 0, len(service.Backends))
+	for _, backend := range service.Backends {
+		if backend.IsHealthy && !backend.IsDraining && !tried[backend.ContainerName] && backend.outlier.available(now) && backend.breaker.allow(now, circuitConfig) {
+			healthyBackends = append(healthyBackends, backend)
+		}
+	}
+	if len(healthyBackends) == 0 {
 		return nil
 	}
-	backend := backends[nextBackendIndex%len(backends)]
-	nextBackendIndex++
-	if backend.IsHealthy {
-		return backend
-	} else {
-		//find next healthy backend
-		for i := 0; i < len(backends); i++ {
-			backend = backends[nextBackendIndex%len(backends)]
-			nextBackendIndex++
-			if backend.IsHealthy {
-				return backend
-			}
-		}
+	key := ""
+	if service.Strategy == StrategyConsistentHash {
+		key = hashKey(service)
 	}
-	return nil
+	backend := s.strategy.Next(healthyBackends, key)
+	backend.outlier.picked()
+	backend.breaker.picked(now, circuitConfig)
+	return backend
 }
 
 func proxy(w http.ResponseWriter, r *http.Request) {
-	backend := getNextBackend()
-	if backend == nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
+	start := time.Now()
+	route := routeRequest(r)
+	target, serviceName := route.service, route.serviceName
+	if redirectToHTTPS(w, r, target) {
+		return
+	}
+	requestsInFlight.WithLabelValues(serviceName).Inc()
+	defer requestsInFlight.WithLabelValues(serviceName).Dec()
+	defer func() {
+		requestDuration.WithLabelValues(serviceName).Observe(time.Since(start).Seconds())
+	}()
+	incoming := &IncomingReq{reqId: r.Header.Get(RequestIDHeader)}
+	if incoming.reqId == "" || len(incoming.reqId) > maxRequestIDLength {
+		incoming.reqId = uuid.NewString()
+	}
+	r.Header.Set(RequestIDHeader, incoming.reqId)
+	r.Header.Set("X-Forwarded-Proto", forwardedProto(r))
+	if strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+		// left over from the h2c upgrade of the client connection, not meant for the backend
+		r.Header.Del("Upgrade")
+		r.Header.Del("Http2-Settings")
+	}
+	w.Header().Set(RequestIDHeader, incoming.reqId)
+	r = r.WithContext(context.WithValue(r.Context(), incomingReqContextKey, incoming))
+	if len(route.rewriters) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), rewritersContextKey, route.rewriters))
+	}
+	r, span := startProxySpan(r, serviceName, incoming.reqId)
+	recorder := &statusRecorder{ResponseWriter: w}
+	w = recorder
+	entry := &accessLogEntry{
+		config:    target.accessLogConfig(),
+		time:      start,
+		method:    r.Method,
+		path:      r.URL.Path,
+		clientIP:  clientIP(r),
+		requestID: incoming.reqId,
+	}
+	defer func() {
+		entry.latency = time.Since(start)
+		entry.status = recorder.status
+		entry.bytes = recorder.bytes
+		logAccess(entry)
+		endSpan(span, recorder.status)
+	}()
+	requests.Add(1)
+	if target == nil {
+		writeError(w, r, http.StatusServiceUnavailable)
+		return
+	}
+	if !target.allowRequest(w, r, serviceName, route.routeID) {
 		return
 	}
-	fmt.Println("Proxying request to", backend.ContainerName, backend.numRequests)
-	backend.numRequests++
-	requestLog = append(requestLog, time.Now())
-	reverseProxies[backend.ContainerName].reverseProxy.ServeHTTP(w, r)
+	mux.Lock()
+	cache := target.cache
+	mux.Unlock()
+	if cache == nil {
+		forward(w, r, target, serviceName, entry)
+		return
+	}
+	// a response served from the cache takes no concurrency slot
+	cache.serve(w, r, serviceName, entry, func(w http.ResponseWriter, r *http.Request, entry *accessLogEntry) {
+		forward(w, r, target, serviceName, entry)
+	})
 }
 
-func cleanupRequestLog() {
-	now := time.Now()
-	sixtySecondsAgo := now.Add(-60 * time.Second)
-	i := 0
-	for ; i < len(requestLog); i++ {
-		if requestLog[i].After(sixtySecondsAgo) {
-			break
+// forward sends the request to a backend of the service once it gets a concurrency slot,
+// and to the next backend as long as the retry policy allows
+func forward(w http.ResponseWriter, r *http.Request, target *balancedService, serviceName string, entry *accessLogEntry) {
+	release, ok := target.acquireConcurrency(w, r, serviceName)
+	if !ok {
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	w = recorder
+	acquired := time.Now()
+	defer func() {
+		// the time to the response headers, a long download does not make the backend slow
+		latency := time.Since(acquired)
+		if !recorder.headerTime.IsZero() {
+			latency = recorder.headerTime.Sub(acquired)
 		}
+		release(latency, recorder.status >= 500)
+	}()
+	target.retries.recordRequest()
+	policy := getRetryPolicy(target)
+	canRetry := policy.maxAttempts > 1 && policy.allowsMethod(r.Method)
+	var body []byte
+	if canRetry {
+		body, canRetry = bufferRequestBody(r)
+	}
+	tried := make(map[string]bool)
+	lastStatus := http.StatusServiceUnavailable
+	lastGRPCStatus := 0
+	for attempt := 1; ; attempt++ {
+		backend := target.getNextBackend(r, tried)
+		if backend == nil && lastGRPCStatus != 0 {
+			writeGRPCError(w, lastGRPCStatus, errorMessage(r, "no backend left to retry the call"))
+			return
+		}
+		if backend == nil {
+			writeError(w, r, lastStatus)
+			return
+		}
+		tried[backend.ContainerName] = true
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		retryable := canRetry && attempt < policy.maxAttempts && target.retries.canRetry(policy.budgetPercent)
+		rw := newRetryWriter(w, retryable, policy)
+		attemptStart := time.Now()
+		attemptRequest, attemptSpan := startAttemptSpan(r, backend, attempt)
+		proxyToBackend(rw, attemptRequest, target, backend)
+		endSpan(attemptSpan, rw.status)
+		observeAttempt(serviceName, backend, rw.status, attemptStart)
+		entry.upstream = backend.ContainerName
+		entry.upstreamLatency = time.Since(attemptStart)
+		if !rw.swallowed || r.Context().Err() != nil {
+			return
+		}
+		lastStatus = rw.status
+		lastGRPCStatus = rw.grpcStatus
+		target.retries.recordRetry()
+		retriesTotal.WithLabelValues(serviceName).Inc()
+		entry.retries++
+	}
+}
+
+func proxyToBackend(w http.ResponseWriter, r *http.Request, target *balancedService, backend *BackendServer) {
+	atomic.AddInt64(&backend.numRequests, 1)
+	atomic.AddInt64(&backend.activeRequests, 1)
+	defer atomic.AddInt64(&backend.activeRequests, -1)
+	reverseProxy := target.getReverseProxy(backend.ContainerName)
+	if reverseProxy == nil {
+		// the backend was removed after it was picked, the request never reached it
+		releaseUpstream(backend)
+		writeError(w, r, http.StatusServiceUnavailable)
+		return
+	}
+	reverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendContextKey, backend)))
+}
+
+// writeError answers with a plain text error that carries the request id, so a client failure
+// can be matched with the access log of the balancer. gRPC calls get the error as a gRPC status.
+func writeError(w http.ResponseWriter, r *http.Request, status int) {
+	message := errorMessage(r, http.StatusText(status))
+	if isGRPCRequest(r) {
+		writeGRPCError(w, grpcStatusForHTTP(status), message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func errorMessage(r *http.Request, message string) string {
+	if incoming, ok := r.Context().Value(incomingReqContextKey).(*IncomingReq); ok {
+		return fmt.Sprintf("%s (request id %s)", message, incoming.reqId)
 	}
-	// Remove old entries
-	requestLog = requestLog[i:]
+	return message
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_requests_total",
+		Help: "Requests proxied to a backend, by response status code.",
+	}, []string{"service", "backend", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_request_duration_seconds",
+		Help:    "Total time spent serving a client request, retries included.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_upstream_request_duration_seconds",
+		Help:    "Time spent on a single attempt against a backend.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "backend"})
+
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_requests_in_flight",
+		Help: "Client requests currently being served.",
+	}, []string{"service"})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_upstream_errors_total",
+		Help: "Attempts that failed without a response from the backend.",
+	}, []string{"service", "backend"})
+
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_retries_total",
+		Help: "Requests sent again to another backend.",
+	}, []string{"service"})
+
+	rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_rate_limited_requests_total",
+		Help: "Requests answered with 429 because they were over the rate limit of the service.",
+	}, []string{"service"})
+
+	requestsShedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_requests_shed_total",
+		Help: "Requests answered with 503 because the service was at its concurrency limit, by priority class.",
+	}, []string{"service", "priority"})
+
+	cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_cache_requests_total",
+		Help: "Requests to a service with a cache, by how the cache answered: hit, stale, revalidated, miss or bypass.",
+	}, []string{"service", "result"})
+
+	tcpConnectionsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_tcp_connections_active",
+		Help: "Client connections currently proxied in tcp mode.",
+	}, []string{"service"})
+
+	udpFlowsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_udp_flows_active",
+		Help: "Client addresses with an open flow to a backend in udp mode.",
+	}, []string{"service"})
+
+	serviceVersionGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_service_version",
+		Help: "Version of the service definition last applied from the orchestrator.",
+	}, []string{"service"})
+)
+
+var (
+	backendRequestsDesc = prometheus.NewDesc("lb_backend_requests_total",
+		"Requests sent to the backend since the load balancer started.", []string{"service", "backend"}, nil)
+	backendActiveRequestsDesc = prometheus.NewDesc("lb_backend_active_requests",
+		"Requests in flight to the backend.", []string{"service", "backend"}, nil)
+	backendHealthyDesc = prometheus.NewDesc("lb_backend_healthy",
+		"1 if the orchestrator reports the backend healthy.", []string{"service", "backend"}, nil)
+	backendDrainingDesc = prometheus.NewDesc("lb_backend_draining",
+		"1 if the backend is draining and gets no new requests.", []string{"service", "backend"}, nil)
+	backendEjectedDesc = prometheus.NewDesc("lb_backend_ejected",
+		"1 if the backend is ejected by outlier detection.", []string{"service", "backend"}, nil)
+	backendCircuitDesc = prometheus.NewDesc("lb_backend_circuit_state",
+		"Circuit breaker state of the backend, 0 closed, 1 half-open, 2 open.", []string{"service", "backend"}, nil)
+	concurrencyLimitDesc = prometheus.NewDesc("lb_concurrency_limit",
+		"Requests the service may have in flight, only exported when the service has a concurrency limit.", []string{"service"}, nil)
+	concurrencyQueuedDesc = prometheus.NewDesc("lb_concurrency_queued_requests",
+		"Requests waiting for the concurrency limit of the service.", []string{"service"}, nil)
+	cacheBytesDesc = prometheus.NewDesc("lb_cache_bytes",
+		"Size of the responses the cache of the service keeps, by tier.", []string{"service", "tier"}, nil)
+	roundRobinIndexDesc = prometheus.NewDesc("lb_round_robin_next_index",
+		"Position of the round-robin strategy, only exported when the service uses it.", []string{"service"}, nil)
+)
+
+// forgetBackendMetrics drops the series of a backend that left the service, replaced containers get new names
+// and their series would pile up otherwise. The backendCollector series go with the backend on their own.
+func forgetBackendMetrics(serviceName string, containerName string) {
+	labels := prometheus.Labels{"service": serviceName, "backend": containerName}
+	requestsTotal.DeletePartialMatch(labels)
+	upstreamDuration.Delete(labels)
+	upstreamErrorsTotal.Delete(labels)
+}
+
+// backendCollector reads the per-backend state when metrics are scraped instead of keeping copies of it
+type backendCollector struct{}
+
+func (c backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendRequestsDesc
+	ch <- backendActiveRequestsDesc
+	ch <- backendHealthyDesc
+	ch <- backendDrainingDesc
+	ch <- backendEjectedDesc
+	ch <- backendCircuitDesc
+	ch <- concurrencyLimitDesc
+	ch <- concurrencyQueuedDesc
+	ch <- cacheBytesDesc
+	ch <- roundRobinIndexDesc
+}
+
+func (c backendCollector) Collect(ch chan<- prometheus.Metric) {
+	mux.Lock()
+	defer mux.Unlock()
+	now := time.Now()
+	for _, s := range allServices() {
+		s.collect(ch, now)
+	}
+}
+
+func (s *balancedService) collect(ch chan<- prometheus.Metric, now time.Time) {
+	service := &s.service
+	circuitConfig := getCircuitConfig(service)
+	for _, backend := range service.Backends {
+		ch <- prometheus.MustNewConstMetric(backendRequestsDesc, prometheus.CounterValue,
+			float64(atomic.LoadInt64(&backend.numRequests)), service.Name, backend.ContainerName)
+		ch <- prometheus.MustNewConstMetric(backendActiveRequestsDesc, prometheus.GaugeValue,
+			float64(atomic.LoadInt64(&backend.activeRequests)), service.Name, backend.ContainerName)
+		ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue,
+			boolToFloat(backend.IsHealthy), service.Name, backend.ContainerName)
+		ch <- prometheus.MustNewConstMetric(backendDrainingDesc, prometheus.GaugeValue,
+			boolToFloat(backend.IsDraining), service.Name, backend.ContainerName)
+		ch <- prometheus.MustNewConstMetric(backendEjectedDesc, prometheus.GaugeValue,
+			boolToFloat(!backend.outlier.available(now)), service.Name, backend.ContainerName)
+		circuitState := 0.0
+		switch backend.breaker.status(backend, now, circuitConfig).State {
+		case CircuitHalfOpen:
+			circuitState = 1
+		case CircuitOpen:
+			circuitState = 2
+		}
+		ch <- prometheus.MustNewConstMetric(backendCircuitDesc, prometheus.GaugeValue,
+			circuitState, service.Name, backend.ContainerName)
+	}
+	if s.concurrency != nil {
+		limit, waiting := s.concurrency.currentLimit()
+		ch <- prometheus.MustNewConstMetric(concurrencyLimitDesc, prometheus.GaugeValue, float64(limit), service.Name)
+		ch <- prometheus.MustNewConstMetric(concurrencyQueuedDesc, prometheus.GaugeValue, float64(waiting), service.Name)
+	}
+	if s.cache != nil {
+		memory, disk := s.cache.size()
+		ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(memory), service.Name, "memory")
+		ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(disk), service.Name, "disk")
+	}
+	if roundRobin, ok := s.strategy.(*roundRobin); ok {
+		ch <- prometheus.MustNewConstMetric(roundRobinIndexDesc, prometheus.GaugeValue,
+			float64(roundRobin.nextBackendIndex), service.Name)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		requestsTotal,
+		requestDuration,
+		upstreamDuration,
+		requestsInFlight,
+		upstreamErrorsTotal,
+		retriesTotal,
+		rateLimitedTotal,
+		requestsShedTotal,
+		cacheRequestsTotal,
+		tcpConnectionsActive,
+		udpFlowsActive,
+		serviceVersionGauge,
+		accessLogDropped,
+		backendCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+func observeAttempt(serviceName string, backend *BackendServer, status int, start time.Time) {
+	requestsTotal.WithLabelValues(serviceName, backend.ContainerName, strconv.Itoa(status)).Inc()
+	upstreamDuration.WithLabelValues(serviceName, backend.ContainerName).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutlierConsecutiveFailures = 5
+	defaultOutlierErrorRatePercent    = 50
+	defaultOutlierBaseEjectionSeconds = 30
+	defaultOutlierMaxEjectionPercent  = 50
+
+	// error rate is only considered once a window has seen this many requests
+	outlierMinRequests = 20
+	outlierWindow      = 10 * time.Second
+	maxEjectionTime    = 5 * time.Minute
+)
+
+type outlierConfig struct {
+	consecutiveFailures int
+	errorRatePercent    int
+	baseEjectionTime    time.Duration
+	maxEjectionPercent  int
+}
+
+func getOutlierConfig(service *Service) outlierConfig {
+	config := outlierConfig{
+		consecutiveFailures: service.OutlierConsecutiveFailures,
+		errorRatePercent:    service.OutlierErrorRatePercent,
+		baseEjectionTime:    time.Duration(service.OutlierBaseEjectionSeconds) * time.Second,
+		maxEjectionPercent:  service.OutlierMaxEjectionPercent,
+	}
+	if config.consecutiveFailures <= 0 {
+		config.consecutiveFailures = defaultOutlierConsecutiveFailures
+	}
+	if config.errorRatePercent <= 0 {
+		config.errorRatePercent = defaultOutlierErrorRatePercent
+	}
+	if config.baseEjectionTime <= 0 {
+		config.baseEjectionTime = defaultOutlierBaseEjectionSeconds * time.Second
+	}
+	if config.maxEjectionPercent <= 0 {
+		config.maxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+	return config
+}
+
+// outlierDetector watches the results of proxied requests to one backend and ejects it locally
+// when it keeps failing, without waiting for the orchestrator health checks to notice.
+// After the ejection ends the backend only gets one probe request at a time until a probe succeeds.
+type outlierDetector struct {
+	lock                sync.Mutex
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+	ejectedUntil        time.Time
+	ejections           int
+	probing             bool
+	probeInFlight       bool
+}
+
+func (o *outlierDetector) available(now time.Time) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if now.Before(o.ejectedUntil) {
+		return false
+	}
+	return !o.probing || !o.probeInFlight
+}
+
+// isEjected counts backends that are ejected or still being probed after an ejection
+func (o *outlierDetector) isEjected(now time.Time) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return now.Before(o.ejectedUntil) || o.probing
+}
+
+func (o *outlierDetector) picked() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.probing {
+		o.probeInFlight = true
+	}
+}
+
+// release frees the probe slot of a request that ended without a result, like a cancelled one
+func (o *outlierDetector) release() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.probeInFlight = false
+}
+
+// record a request result, canEject is false when too many backends of the service are already ejected
+func (o *outlierDetector) record(backend *BackendServer, success bool, config outlierConfig, canEject bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := time.Now()
+	if now.Before(o.ejectedUntil) {
+		// late results of requests sent before the ejection
+		return
+	}
+	if now.Sub(o.windowStart) >= outlierWindow {
+		if o.ejections > 0 && !o.probing {
+			o.ejections--
+		}
+		o.windowStart = now
+		o.windowRequests = 0
+		o.windowFailures = 0
+	}
+	o.windowRequests++
+	if o.probing {
+		o.probeInFlight = false
+		if success {
+			fmt.Println("Backend", backend.ContainerName, "passed the probe, sending traffic again")
+			o.probing = false
+			o.consecutiveFailures = 0
+			return
+		}
+		o.eject(backend, now, config)
+		return
+	}
+	if success {
+		o.consecutiveFailures = 0
+		return
+	}
+	o.consecutiveFailures++
+	o.windowFailures++
+	if !canEject {
+		return
+	}
+	if o.consecutiveFailures >= config.consecutiveFailures ||
+		(o.windowRequests >= outlierMinRequests && o.windowFailures*100 >= o.windowRequests*config.errorRatePercent) {
+		o.eject(backend, now, config)
+	}
+}
+
+// eject doubles the ejection time for every ejection the backend had recently
+func (o *outlierDetector) eject(backend *BackendServer, now time.Time, config outlierConfig) {
+	o.ejections++
+	ejectionTime := config.baseEjectionTime
+	for i := 1; i < o.ejections && ejectionTime < maxEjectionTime; i++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > maxEjectionTime {
+		ejectionTime = maxEjectionTime
+	}
+	fmt.Println("Ejecting backend", backend.ContainerName, "for", ejectionTime)
+	o.ejectedUntil = now.Add(ejectionTime)
+	o.probing = true
+	o.probeInFlight = false
+	o.consecutiveFailures = 0
+	o.windowStart = now
+	o.windowRequests = 0
+	o.windowFailures = 0
+}
+
+// reportUpstreamResult feeds the result of a proxied request into the outlier detection
+// and the circuit breaker of its backend
+func (s *balancedService) reportUpstreamResult(backend *BackendServer, success bool) {
+	mux.Lock()
+	defer mux.Unlock()
+	service := &s.service
+	backend.breaker.record(backend, success, getCircuitConfig(service))
+	config := getOutlierConfig(service)
+	now := time.Now()
+	ejected := 0
+	for _, b := range service.Backends {
+		if b.outlier.isEjected(now) {
+			ejected++
+		}
+	}
+	canEject := (ejected+1)*100 <= len(service.Backends)*config.maxEjectionPercent
+	backend.outlier.record(backend, success, config, canEject)
+}
+
+// releaseUpstream is called for requests that ended without telling anything about the backend
+func releaseUpstream(backend *BackendServer) {
+	backend.outlier.release()
+	backend.breaker.release()
+}
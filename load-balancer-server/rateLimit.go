@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitKeyClientIP = "client-ip"
+	RateLimitKeyHeader   = "header"
+	RateLimitKeyRoute    = "route"
+
+	rateLimitSyncInterval = time.Second
+	// buckets that filled up again are dropped after this long, so one-off clients do not pile up
+	rateLimitSweepInterval = time.Minute
+)
+
+type rateLimitConfig struct {
+	perSecond float64
+	burst     float64
+	key       string
+	header    string
+	global    bool
+}
+
+func getRateLimitConfig(service *Service) rateLimitConfig {
+	config := rateLimitConfig{
+		perSecond: service.RateLimitPerSecond,
+		burst:     float64(service.RateLimitBurst),
+		key:       service.RateLimitKey,
+		header:    service.RateLimitHeader,
+		global:    service.RateLimitGlobal,
+	}
+	if config.burst <= 0 {
+		config.burst = math.Max(1, math.Ceil(config.perSecond))
+	}
+	if config.key == "" {
+		config.key = RateLimitKeyClientIP
+	}
+	return config
+}
+
+// rateLimiter keeps a token bucket per key. In global mode it also counts what it let through,
+// so the balancers of a service can take the requests the others let through out of their own buckets.
+type rateLimiter struct {
+	config    rateLimitConfig
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	// tokens taken since the last sync with the orchestrator, only kept in global mode
+	consumed map[string]float64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when the service has no limit
+func newRateLimiter(service *Service) *rateLimiter {
+	if service.RateLimitPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		config:    getRateLimitConfig(service),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		consumed:  make(map[string]float64),
+	}
+}
+
+// requestKey names the bucket of a request. Header values are hashed as they usually are API keys,
+// a request without the header falls back to its client IP.
+func (l *rateLimiter) requestKey(r *http.Request, routeID uint) string {
+	switch l.config.key {
+	case RateLimitKeyHeader:
+		if value := r.Header.Get(l.config.header); value != "" {
+			sum := sha256.Sum256([]byte(value))
+			return "key:" + hex.EncodeToString(sum[:8])
+		}
+	case RateLimitKeyRoute:
+		return "route:" + strconv.FormatUint(uint64(routeID), 10)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// refill brings the bucket of the key up to now, a new key starts with a full bucket
+func (l *rateLimiter) refill(key string, now time.Time) *tokenBucket {
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.config.burst, last: now}
+		l.buckets[key] = bucket
+		return bucket
+	}
+	bucket.tokens = math.Min(l.config.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.config.perSecond)
+	bucket.last = now
+	return bucket
+}
+
+// allow takes a token for the request, or returns how long until the next token is there
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	bucket := l.refill(key, now)
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.config.perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	if l.config.global {
+		l.consumed[key]++
+	}
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.config.perSecond >= l.config.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// takeConsumed returns the tokens taken since the last call
+func (l *rateLimiter) takeConsumed() map[string]float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	consumed := l.consumed
+	l.consumed = make(map[string]float64)
+	return consumed
+}
+
+// restoreConsumed puts back tokens a failed sync did not report, the next sync reports them
+func (l *rateLimiter) restoreConsumed(consumed map[string]float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for key, tokens := range consumed {
+		l.consumed[key] += tokens
+	}
+}
+
+// consume takes the tokens other balancers used out of the buckets. A bucket can go below zero
+// so a burst spread over several balancers is paid back, but never by more than one burst.
+func (l *rateLimiter) consume(consumed map[string]float64, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for key, tokens := range consumed {
+		bucket := l.refill(key, now)
+		bucket.tokens = math.Max(-l.config.burst, bucket.tokens-tokens)
+	}
+}
+
+// allowRequest applies the rate limit of the service and answers 429 when the request is over it
+func (s *balancedService) allowRequest(w http.ResponseWriter, r *http.Request, serviceName string, routeID uint) bool {
+	mux.Lock()
+	limiter := s.limiter
+	mux.Unlock()
+	if limiter == nil {
+		return true
+	}
+	allowed, retryAfter := limiter.allow(limiter.requestKey(r, routeID), time.Now())
+	if allowed {
+		return true
+	}
+	rateLimitedTotal.WithLabelValues(serviceName).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests)
+	return false
+}
+
+// rateLimitSyncJob shares what the balancer let through with the other balancers of every service
+// in global mode. The limit holds across the balancers within about one sync interval.
+func rateLimitSyncJob() {
+	ticker := time.NewTicker(rateLimitSyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		mux.Lock()
+		limiters := make(map[string]*rateLimiter)
+		for _, s := range allServices() {
+			if s.limiter != nil && s.limiter.config.global {
+				limiters[s.service.Name] = s.limiter
+			}
+		}
+		mux.Unlock()
+		for serviceName, limiter := range limiters {
+			consumed := limiter.takeConsumed()
+			others, err := syncRateLimit(serviceName, consumed)
+			if err != nil {
+				fmt.Println("Error syncing rate limit of", serviceName, ":", err)
+				limiter.restoreConsumed(consumed)
+				continue
+			}
+			limiter.consume(others, time.Now())
+		}
+	}
+}
+
+// syncRateLimit reports the tokens the balancer took and returns the tokens the other balancers took since the last sync
+func syncRateLimit(serviceName string, consumed map[string]float64) (map[string]float64, error) {
+	dat, err := json.Marshal(map[string]interface{}{
+		"service":      serviceName,
+		"loadBalancer": os.Getenv("CONTAINER_NAME"),
+		"consumed":     consumed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpClient := http.Client{
+		Timeout: rateLimitSyncInterval,
+	}
+	resp, err := httpClient.Post(orchestratorURL()+"/api/load-balancers/rate-limits", "application/json", bytes.NewReader(dat))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var body struct {
+		Consumed map[string]float64 `json:"consumed"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	return body.Consumed, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// one bucket per second, enough for a full 60 second window plus the current second
+const counterBuckets = 64
+
+// slidingWindowCounter counts events in a ring of per-second buckets without locking.
+// Every bucket packs the unix second it belongs to in the upper 32 bits and the count in the lower 32 bits,
+// so moving a bucket to a new second and counting in it is a single compare-and-swap.
+type slidingWindowCounter struct {
+	buckets [counterBuckets]uint64
+}
+
+var requests slidingWindowCounter
+
+func (c *slidingWindowCounter) Add(n uint32) {
+	now := uint64(time.Now().Unix())
+	bucket := &c.buckets[now%counterBuckets]
+	for {
+		old := atomic.LoadUint64(bucket)
+		var updated uint64
+		if old>>32 == now&0xffffffff {
+			updated = old + uint64(n)
+		} else {
+			updated = now<<32 | uint64(n)
+		}
+		if atomic.CompareAndSwapUint64(bucket, old, updated) {
+			return
+		}
+	}
+}
+
+// Sum returns the events of the last window, counted in whole seconds and including the current one
+func (c *slidingWindowCounter) Sum(window time.Duration) uint64 {
+	return c.sum(0, uint64(window/time.Second))
+}
+
+// Rate returns the events per second over the last window of completed seconds,
+// the current second is left out because it is only partly counted
+func (c *slidingWindowCounter) Rate(window time.Duration) float64 {
+	seconds := uint64(window / time.Second)
+	if seconds == 0 {
+		return 0
+	}
+	if seconds >= counterBuckets {
+		seconds = counterBuckets - 1
+	}
+	return float64(c.sum(1, seconds)) / float64(seconds)
+}
+
+// sum adds up the buckets of the given number of seconds, starting skip seconds before the current one
+func (c *slidingWindowCounter) sum(skip uint64, seconds uint64) uint64 {
+	now := uint64(time.Now().Unix())
+	if skip+seconds > counterBuckets {
+		seconds = counterBuckets - skip
+	}
+	var sum uint64
+	for i := skip; i < skip+seconds; i++ {
+		value := atomic.LoadUint64(&c.buckets[(now-i)%counterBuckets])
+		if value>>32 == (now-i)&0xffffffff {
+			sum += value & 0xffffffff
+		}
+	}
+	return sum
+}
+
+type RequestRates struct {
+	OneSecond     float64 `json:"1s"`
+	TenSeconds    float64 `json:"10s"`
+	ThirtySeconds float64 `json:"30s"`
+	SixtySeconds  float64 `json:"60s"`
+}
+
+func getRequestRates() RequestRates {
+	return RequestRates{
+		OneSecond:     requests.Rate(time.Second),
+		TenSeconds:    requests.Rate(10 * time.Second),
+		ThirtySeconds: requests.Rate(30 * time.Second),
+		SixtySeconds:  requests.Rate(60 * time.Second),
+	}
+}
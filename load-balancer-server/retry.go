@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryOnStatus      = "502,503,504"
+	defaultRetryBudgetPercent = 20
+
+	// request bodies up to this size are kept in memory so they can be sent again
+	maxRetryBodyBytes = 64 << 10
+
+	retryBudgetWindow = 10 * time.Second
+	// retries always allowed per window, so a quiet service can still retry
+	minRetriesPerWindow = 10
+)
+
+type retryPolicy struct {
+	maxAttempts   int
+	statuses      map[int]bool
+	grpcStatuses  map[int]bool
+	nonIdempotent bool
+	budgetPercent int
+}
+
+func getRetryPolicy(s *balancedService) retryPolicy {
+	mux.Lock()
+	defer mux.Unlock()
+	service := &s.service
+	policy := retryPolicy{
+		maxAttempts:   service.RetryMaxAttempts,
+		nonIdempotent: service.RetryNonIdempotent,
+		budgetPercent: service.RetryBudgetPercent,
+	}
+	if policy.maxAttempts < 1 {
+		policy.maxAttempts = 1
+	}
+	if policy.budgetPercent <= 0 {
+		policy.budgetPercent = defaultRetryBudgetPercent
+	}
+	retryOnStatus := service.RetryOnStatus
+	if retryOnStatus == "" {
+		retryOnStatus = defaultRetryOnStatus
+	}
+	policy.statuses = parseStatuses(retryOnStatus)
+	// gRPC calls are POST requests, they are only retried when the service allows retrying those.
+	// Their request stream is buffered like any other body, which suits unary calls.
+	retryOnGRPCStatus := service.RetryOnGRPCStatus
+	if retryOnGRPCStatus == "" {
+		retryOnGRPCStatus = defaultRetryOnGRPCStatus
+	}
+	policy.grpcStatuses = parseStatuses(retryOnGRPCStatus)
+	return policy
+}
+
+func parseStatuses(list string) map[int]bool {
+	statuses := make(map[int]bool)
+	for _, status := range strings.Split(list, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(status))
+		if err == nil {
+			statuses[code] = true
+		}
+	}
+	return statuses
+}
+
+func (p retryPolicy) allowsMethod(method string) bool {
+	if p.nonIdempotent {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferRequestBody reads small bodies into memory so they can be replayed,
+// it returns false if the body is too large and the request can only be sent once
+func bufferRequestBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > maxRetryBodyBytes {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodyBytes+1))
+	if err != nil || len(body) > maxRetryBodyBytes {
+		// put back what was read in front of the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	return body, true
+}
+
+// retryBudget caps retries to a share of the requests the service got in the last window,
+// so retries cannot multiply the load on a service that is already failing
+type retryBudget struct {
+	requests slidingWindowCounter
+	retries  slidingWindowCounter
+}
+
+func (b *retryBudget) recordRequest() {
+	b.requests.Add(1)
+}
+
+func (b *retryBudget) canRetry(percent int) bool {
+	retried := b.retries.Sum(retryBudgetWindow)
+	return retried < minRetriesPerWindow || retried*100 < b.requests.Sum(retryBudgetWindow)*uint64(percent)
+}
+
+func (b *retryBudget) recordRetry() {
+	b.retries.Add(1)
+}
+
+// retryWriter holds back the response of an attempt that may be retried,
+// a retryable response is swallowed instead of being sent to the client.
+// gRPC calls are retried on the status of a trailers-only response, a call that sent messages is never taken back.
+type retryWriter struct {
+	http.ResponseWriter
+	header         http.Header
+	canRetry       bool
+	statuses       map[int]bool
+	grpcStatuses   map[int]bool
+	upstreamFailed bool
+	wroteHeader    bool
+	passthrough    bool
+	swallowed      bool
+	status         int
+	grpcStatus     int
+}
+
+func newRetryWriter(w http.ResponseWriter, canRetry bool, policy retryPolicy) *retryWriter {
+	return &retryWriter{
+		ResponseWriter: w,
+		header:         make(http.Header),
+		canRetry:       canRetry,
+		statuses:       policy.statuses,
+		grpcStatuses:   policy.grpcStatuses,
+	}
+}
+
+func (w *retryWriter) Header() http.Header {
+	if w.passthrough {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *retryWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status < http.StatusOK {
+		// informational responses cannot be taken back, so they are dropped while a retry is possible
+		if !w.canRetry {
+			for key, values := range w.header {
+				w.ResponseWriter.Header()[key] = values
+			}
+			w.ResponseWriter.WriteHeader(status)
+			for key := range w.header {
+				w.ResponseWriter.Header().Del(key)
+			}
+		}
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	grpcStatus, grpcFailed := grpcStatusOf(w.header)
+	if grpcFailed {
+		w.grpcStatus = grpcStatus
+		grpcFailed = w.grpcStatuses[grpcStatus]
+	}
+	if w.canRetry && (w.upstreamFailed || w.statuses[status] || grpcFailed) {
+		w.swallowed = true
+		return
+	}
+	w.passthrough = true
+	for key, values := range w.header {
+		for _, value := range values {
+			w.ResponseWriter.Header().Add(key, value)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *retryWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.swallowed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *retryWriter) Flush() {
+	if !w.passthrough {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *retryWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
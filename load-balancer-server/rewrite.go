@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewriteRules change requests on their way to a backend and responses on their way back.
+// A service and a route can both have rules, the rules of the route run first.
+// Headers are removed first, then set, replacing any value, then added next to the values already there.
+type RewriteRules struct {
+	// "/api" turns "/api/users" into "/users", only whole path segments are stripped
+	StripPathPrefix string `json:"stripPathPrefix"`
+	// runs on the escaped path after the prefix is stripped, the replacement can refer to groups as $1.
+	// The query is not part of the path and is passed on as it is.
+	PathRegex             string            `json:"pathRegex"`
+	PathReplacement       string            `json:"pathReplacement"`
+	Host                  string            `json:"host"`
+	RemoveRequestHeaders  []string          `json:"removeRequestHeaders"`
+	SetRequestHeaders     map[string]string `json:"setRequestHeaders"`
+	AddRequestHeaders     map[string]string `json:"addRequestHeaders"`
+	RemoveResponseHeaders []string          `json:"removeResponseHeaders"`
+	SetResponseHeaders    map[string]string `json:"setResponseHeaders"`
+	AddResponseHeaders    map[string]string `json:"addResponseHeaders"`
+}
+
+type rewriter struct {
+	rules     RewriteRules
+	pathRegex *regexp.Regexp
+}
+
+// newRewriter returns nil for no rules, so requests without rules skip the rewriting
+func newRewriter(rules *RewriteRules) *rewriter {
+	if rules == nil {
+		return nil
+	}
+	rw := &rewriter{rules: *rules}
+	if rules.PathRegex != "" {
+		pathRegex, err := regexp.Compile(rules.PathRegex)
+		if err != nil {
+			fmt.Println("Error compiling path regex", rules.PathRegex, ":", err)
+		}
+		rw.pathRegex = pathRegex
+	}
+	rw.rules.StripPathPrefix = strings.TrimSuffix(rules.StripPathPrefix, "/")
+	return rw
+}
+
+// rewriteRequest runs on the request the reverse proxy sends, so every retry starts from the original request
+func (rw *rewriter) rewriteRequest(r *http.Request) {
+	rules := &rw.rules
+	if rules.StripPathPrefix != "" || rw.pathRegex != nil {
+		path := r.URL.EscapedPath()
+		if rules.StripPathPrefix != "" && (path == rules.StripPathPrefix || strings.HasPrefix(path, rules.StripPathPrefix+"/")) {
+			path = "/" + strings.TrimPrefix(path[len(rules.StripPathPrefix):], "/")
+		}
+		if rw.pathRegex != nil {
+			path = rw.pathRegex.ReplaceAllString(path, rules.PathReplacement)
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		unescaped, err := url.PathUnescape(path)
+		if err == nil {
+			r.URL.Path = unescaped
+			r.URL.RawPath = path
+		}
+	}
+	if rules.Host != "" {
+		if r.Header.Get("X-Forwarded-Host") == "" {
+			r.Header.Set("X-Forwarded-Host", r.Host)
+		}
+		r.Host = rules.Host
+	}
+	rewriteHeader(r.Header, rules.RemoveRequestHeaders, rules.SetRequestHeaders, rules.AddRequestHeaders)
+}
+
+func (rw *rewriter) rewriteResponse(resp *http.Response) {
+	rules := &rw.rules
+	rewriteHeader(resp.Header, rules.RemoveResponseHeaders, rules.SetResponseHeaders, rules.AddResponseHeaders)
+}
+
+func rewriteHeader(header http.Header, remove []string, set map[string]string, add map[string]string) {
+	for _, name := range remove {
+		header.Del(name)
+	}
+	for name, value := range set {
+		header.Set(name, value)
+	}
+	for name, value := range add {
+		header.Add(name, value)
+	}
+}
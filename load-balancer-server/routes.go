@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Route sends the requests it matches to a service. Routes are shared by every balancer so any balancer
+// pool can front many services, requests no route matches go to the service of the balancer.
+// An empty matcher matches every request, a header matcher with an empty value only asks for the header.
+type Route struct {
+	ID         uint              `json:"id"`
+	Priority   int               `json:"priority"`
+	Host       string            `json:"host"`
+	PathPrefix string            `json:"pathPrefix"`
+	Headers    map[string]string `json:"headers"`
+	Methods    []string          `json:"methods"`
+	Service    string            `json:"service"`
+	Rewrite    *RewriteRules     `json:"rewrite"`
+
+	rewriter *rewriter
+}
+
+type routeTable struct {
+	Version uint64  `json:"version"`
+	Routes  []Route `json:"routes"`
+}
+
+// compiledRoutes finds the route of a request by its host first and then along the segments of its path.
+// An exact host goes before a wildcard host and a wildcard before routes for any host,
+// within a host the longest matching path prefix wins and routes on the same prefix go by priority.
+type compiledRoutes struct {
+	exactHosts map[string]*routeNode
+	// by the suffix following the "*", like ".example.com"
+	wildcardHosts map[string]*routeNode
+	anyHost       *routeNode
+}
+
+type routeNode struct {
+	children map[string]*routeNode
+	// the routes with a path prefix ending at this node, in the order they are tried
+	routes []*Route
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{children: make(map[string]*routeNode)}
+}
+
+func compileRoutes(routes []Route) *compiledRoutes {
+	compiled := &compiledRoutes{
+		exactHosts:    make(map[string]*routeNode),
+		wildcardHosts: make(map[string]*routeNode),
+	}
+	for i := range routes {
+		route := &routes[i]
+		route.rewriter = newRewriter(route.Rewrite)
+		for j, method := range route.Methods {
+			route.Methods[j] = strings.ToUpper(method)
+		}
+		host := strings.ToLower(route.Host)
+		var node *routeNode
+		switch {
+		case host == "" || host == "*":
+			if compiled.anyHost == nil {
+				compiled.anyHost = newRouteNode()
+			}
+			node = compiled.anyHost
+		case strings.HasPrefix(host, "*."):
+			node = compiled.wildcardHosts[host[1:]]
+			if node == nil {
+				node = newRouteNode()
+				compiled.wildcardHosts[host[1:]] = node
+			}
+		default:
+			node = compiled.exactHosts[host]
+			if node == nil {
+				node = newRouteNode()
+				compiled.exactHosts[host] = node
+			}
+		}
+		for _, segment := range strings.Split(route.PathPrefix, "/") {
+			if segment == "" {
+				continue
+			}
+			child, ok := node.children[segment]
+			if !ok {
+				child = newRouteNode()
+				node.children[segment] = child
+			}
+			node = child
+		}
+		node.routes = append(node.routes, route)
+		slices.SortStableFunc(node.routes, func(a, b *Route) int {
+			if a.Priority != b.Priority {
+				return b.Priority - a.Priority
+			}
+			return int(a.ID) - int(b.ID)
+		})
+	}
+	return compiled
+}
+
+func (c *compiledRoutes) match(r *http.Request) *Route {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if node, ok := c.exactHosts[host]; ok {
+		if route := node.match(r); route != nil {
+			return route
+		}
+	}
+	// the longest wildcard first, a.b.example.com tries *.b.example.com before *.example.com
+	for i := strings.IndexByte(host, '.'); i >= 0 && len(c.wildcardHosts) > 0; {
+		if node, ok := c.wildcardHosts[host[i:]]; ok {
+			if route := node.match(r); route != nil {
+				return route
+			}
+		}
+		next := strings.IndexByte(host[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	if c.anyHost != nil {
+		return c.anyHost.match(r)
+	}
+	return nil
+}
+
+// match walks down the path as far as the trie goes and tries the routes from the deepest node up
+func (n *routeNode) match(r *http.Request) *Route {
+	nodes := []*routeNode{n}
+	node := n
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if segment == "" {
+			continue
+		}
+		child, ok := node.children[segment]
+		if !ok {
+			break
+		}
+		node = child
+		nodes = append(nodes, node)
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		for _, route := range nodes[i].routes {
+			if route.matches(r) {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if len(route.Methods) > 0 && !slices.Contains(route.Methods, r.Method) {
+		return false
+	}
+	for name, value := range route.Headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || (value != "" && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// routedServiceNames lists the services the routes send requests to, other than the service of the balancer
+func routedServiceNames(routes []Route, homeService string) map[string]bool {
+	names := make(map[string]bool)
+	for _, route := range routes {
+		if route.Service != homeService {
+			names[route.Service] = true
+		}
+	}
+	return names
+}
+
+var (
+	// the routes last applied and their compiled form, guarded by mux
+	routeList *routeTable
+	routes    *compiledRoutes
+)
+
+// homeServiceName is known before the first update of the service arrives
+func homeServiceName() string {
+	if name := os.Getenv("SERVICE_NAME"); name != "" {
+		return name
+	}
+	return home.service.Name
+}
+
+// requestRoute is where a request goes, service is nil for a route to a service the balancer does not know
+type requestRoute struct {
+	service     *balancedService
+	serviceName string
+	// 0 when no route matched
+	routeID uint
+	// the rewriters of the route and the service, in the order they run
+	rewriters []*rewriter
+}
+
+func routeRequest(r *http.Request) requestRoute {
+	mux.Lock()
+	defer mux.Unlock()
+	target := requestRoute{service: home, serviceName: home.service.Name}
+	if routes != nil {
+		if route := routes.match(r); route != nil {
+			target.routeID = route.ID
+			if route.Service != homeServiceName() {
+				target.service, target.serviceName = routedServices[route.Service], route.Service
+			}
+			if route.rewriter != nil {
+				target.rewriters = append(target.rewriters, route.rewriter)
+			}
+		}
+	}
+	if target.service != nil && target.service.rewriter != nil {
+		target.rewriters = append(target.rewriters, target.service.rewriter)
+	}
+	return target
+}
+
+// setRoutes switches to a new route table, the services it sends requests to get a place
+// to receive their definition and the services no longer routed to are dropped. mux must be held.
+func setRoutes(table routeTable) {
+	routeList = &table
+	routes = compileRoutes(table.Routes)
+	names := routedServiceNames(table.Routes, homeServiceName())
+	for name := range names {
+		if _, ok := routedServices[name]; !ok {
+			routedServices[name] = newBalancedService()
+		}
+	}
+	for name := range routedServices {
+		if !names[name] {
+			for _, backend := range routedServices[name].service.Backends {
+				forgetBackendMetrics(name, backend.ContainerName)
+			}
+			delete(routedServices, name)
+		}
+	}
+	updateCertificates()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultServiceCacheFile = "/tmp/load-balancer-service.json"
+
+// how long a load balancer without a config file or cache waits for the orchestrator before serving
+const bootSnapshotTimeout = 10 * time.Second
+
+func serviceCacheFile() string {
+	cacheFile := os.Getenv("SERVICE_CACHE_FILE")
+	if cacheFile == "" {
+		return defaultServiceCacheFile
+	}
+	return cacheFile
+}
+
+// serviceConfigFile is the service definition with its backends, optionally with routes
+// and the definitions of the other services they send requests to
+type serviceConfigFile struct {
+	Service
+	Routes   []Route   `json:"routes"`
+	Services []Service `json:"services"`
+}
+
+// loadServiceConfig boots the load balancer from a JSON file holding the service definition with its backends
+func loadServiceConfig(path string) bool {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println("Error reading service config:", err)
+		return false
+	}
+	var config serviceConfigFile
+	err = json.Unmarshal(dat, &config)
+	if err != nil {
+		fmt.Println("Error parsing service config:", err)
+		return false
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	home.setService(config.Service)
+	setRoutes(routeTable{Routes: config.Routes})
+	for _, routedService := range config.Services {
+		if s, ok := routedServices[routedService.Name]; ok {
+			s.setService(routedService)
+		}
+	}
+	fmt.Println("Loaded service", config.Name, "with", len(config.Routes), "routes from", path)
+	return true
+}
+
+// reloadServiceConfigOnHangup reads the config file again on SIGHUP, which is how a standalone
+// load balancer picks up new backends and renewed certificates without a restart
+func reloadServiceConfigOnHangup(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		loadServiceConfig(path)
+	}
+}
+
+// serviceCache holds the service of the load balancer at the top level, the way caches
+// from before routing did, with the routes and the services they send requests to
+type serviceCache struct {
+	serviceSnapshot
+	Routes         *routeTable       `json:"routes,omitempty"`
+	RoutedServices []serviceSnapshot `json:"routedServices,omitempty"`
+}
+
+// loadServiceCache boots the load balancer from the last service version it applied,
+// so it keeps serving its backends while the orchestrator is unreachable
+func loadServiceCache() bool {
+	dat, err := os.ReadFile(serviceCacheFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error reading service cache:", err)
+		}
+		return false
+	}
+	var cache serviceCache
+	err = json.Unmarshal(dat, &cache)
+	if err != nil {
+		fmt.Println("Error parsing service cache:", err)
+		return false
+	}
+	if cache.Service.Name != os.Getenv("SERVICE_NAME") {
+		return false
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	home.setService(cache.Service)
+	home.version = cache.Version
+	serviceVersionGauge.WithLabelValues(cache.Service.Name).Set(float64(cache.Version))
+	if cache.Routes != nil {
+		setRoutes(*cache.Routes)
+	}
+	for _, snapshot := range cache.RoutedServices {
+		s, ok := routedServices[snapshot.Service.Name]
+		if !ok {
+			continue
+		}
+		s.setService(snapshot.Service)
+		s.version = snapshot.Version
+		serviceVersionGauge.WithLabelValues(snapshot.Service.Name).Set(float64(snapshot.Version))
+	}
+	fmt.Println("Loaded service", cache.Service.Name, "version", cache.Version, "from cache")
+	return true
+}
+
+// every stream saves the cache after an update, the writes go one at a time
+var saveServiceCacheLock sync.Mutex
+
+// saveServiceCache writes the services as snapshots, going through a temporary file
+// so a crash never leaves a half written cache behind
+func saveServiceCache() {
+	saveServiceCacheLock.Lock()
+	defer saveServiceCacheLock.Unlock()
+	mux.Lock()
+	cache := serviceCache{
+		serviceSnapshot: cachedSnapshot(home),
+		Routes:          routeList,
+	}
+	for _, s := range routedServices {
+		cache.RoutedServices = append(cache.RoutedServices, cachedSnapshot(s))
+	}
+	// the backends change under mux
+	dat, err := json.Marshal(cache)
+	mux.Unlock()
+	if err != nil {
+		fmt.Println("Error marshalling service cache:", err)
+		return
+	}
+	cacheFile := serviceCacheFile()
+	tmp, err := os.CreateTemp(filepath.Dir(cacheFile), filepath.Base(cacheFile)+".*")
+	if err != nil {
+		fmt.Println("Error writing service cache:", err)
+		return
+	}
+	_, err = tmp.Write(dat)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cacheFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Println("Error writing service cache:", err)
+	}
+}
+
+// cachedSnapshot leaves the keys of the certificates out of the cache, they are fetched again after a restart. mux must be held.
+func cachedSnapshot(s *balancedService) serviceSnapshot {
+	service := s.service
+	service.Certificates = withoutKeys(service.Certificates)
+	return serviceSnapshot{Version: s.version, Service: service}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultOrchestratorURL = "http://host.docker.internal:3000"
+
+const (
+	ServiceEventSnapshot = "snapshot"
+	ServiceEventDelta    = "delta"
+	RouteEventRoutes     = "routes"
+)
+
+// the orchestrator sends a heartbeat every 15 seconds, a stream silent for longer is dead
+const serviceStreamIdleTimeout = 45 * time.Second
+
+const maxServiceStreamBackoff = 30 * time.Second
+
+// set when the process shuts down, a closed stream is not reopened after that
+var stopServiceStream atomic.Bool
+
+type serviceSnapshot struct {
+	Version uint64  `json:"version"`
+	Service Service `json:"service"`
+}
+
+type backendsDelta struct {
+	Version     uint64           `json:"version"`
+	BaseVersion uint64           `json:"baseVersion"`
+	Backends    []*BackendServer `json:"backends"`
+	Removed     []string         `json:"removed"`
+}
+
+var errMissedServiceUpdate = errors.New("missed a service update")
+
+var (
+	firstServiceUpdate     = make(chan struct{})
+	firstServiceUpdateOnce sync.Once
+)
+
+// waitForServiceUpdate blocks until the first update from the orchestrator is applied or the timeout passes
+func waitForServiceUpdate(timeout time.Duration) {
+	select {
+	case <-firstServiceUpdate:
+	case <-time.After(timeout):
+		fmt.Println("No service update from the orchestrator after", timeout, "serving without backends")
+	}
+}
+
+func orchestratorURL() string {
+	orchestrator := os.Getenv("ORCHESTRATOR_URL")
+	if orchestrator == "" {
+		return defaultOrchestratorURL
+	}
+	return strings.TrimSuffix(orchestrator, "/")
+}
+
+// serviceStreamJob keeps the load balancer subscribed to the updates of a service until ctx is done
+func serviceStreamJob(ctx context.Context, serviceName string, s *balancedService) {
+	streamJob(ctx, "Service update stream of "+serviceName, func() (bool, error) {
+		query := url.Values{
+			"service":      {serviceName},
+			"loadBalancer": {os.Getenv("CONTAINER_NAME")},
+		}
+		return readEventStream(ctx, "/api/load-balancers/stream?"+query.Encode(), func(event string, data []byte) error {
+			return applyServiceEvent(s, serviceName, event, data)
+		})
+	})
+}
+
+// routesStreamJob keeps the load balancer subscribed to the route table shared by all load balancers
+func routesStreamJob() {
+	streamJob(context.Background(), "Route update stream", func() (bool, error) {
+		query := url.Values{"loadBalancer": {os.Getenv("CONTAINER_NAME")}}
+		return readEventStream(context.Background(), "/api/load-balancers/routes/stream?"+query.Encode(), applyRoutesEvent)
+	})
+}
+
+// streamJob reads a stream of the orchestrator, reconnecting with a backoff whenever it breaks
+func streamJob(ctx context.Context, name string, read func() (bool, error)) {
+	backoff := time.Second
+	for {
+		received, err := read()
+		if stopServiceStream.Load() || ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = time.Second
+		}
+		fmt.Println(name, "closed:", err, "reconnecting in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxServiceStreamBackoff {
+			backoff = maxServiceStreamBackoff
+		}
+	}
+}
+
+// readEventStream applies the server-sent events of the orchestrator until the stream ends,
+// it reports whether any event was applied
+func readEventStream(ctx context.Context, path string, apply func(event string, data []byte) error) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orchestratorURL()+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	idle := time.AfterFunc(serviceStreamIdleTimeout, cancel)
+	defer idle.Stop()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	received := false
+	event := ""
+	var data bytes.Buffer
+	for scanner.Scan() {
+		idle.Reset(serviceStreamIdleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				err := apply(event, data.Bytes())
+				if err != nil {
+					return received, err
+				}
+				received = true
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// heartbeat
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return received, err
+	}
+	return received, io.EOF
+}
+
+func applyServiceEvent(s *balancedService, serviceName string, event string, data []byte) error {
+	var version uint64
+	switch event {
+	case ServiceEventSnapshot:
+		var snapshot serviceSnapshot
+		err := json.Unmarshal(data, &snapshot)
+		if err != nil {
+			return err
+		}
+		// reconnecting retries the keys along with a new snapshot
+		err = s.loadCertificateKeys(serviceName, snapshot.Service.Certificates)
+		if err != nil {
+			return err
+		}
+		mux.Lock()
+		s.setService(snapshot.Service)
+		s.version = snapshot.Version
+		version = s.version
+		mux.Unlock()
+	case ServiceEventDelta:
+		var delta backendsDelta
+		err := json.Unmarshal(data, &delta)
+		if err != nil {
+			return err
+		}
+		mux.Lock()
+		if delta.BaseVersion != s.version {
+			mux.Unlock()
+			// reconnecting starts over from a snapshot
+			return errMissedServiceUpdate
+		}
+		updated := s.service
+		updated.Backends = applyBackendsDelta(s.service.Backends, delta)
+		s.setService(updated)
+		s.version = delta.Version
+		version = s.version
+		mux.Unlock()
+	default:
+		return nil
+	}
+	serviceVersionGauge.WithLabelValues(serviceName).Set(float64(version))
+	if s == home {
+		firstServiceUpdateOnce.Do(func() { close(firstServiceUpdate) })
+	}
+	saveServiceCache()
+	go ackServiceVersion(serviceName, version)
+	return nil
+}
+
+func applyRoutesEvent(event string, data []byte) error {
+	if event != RouteEventRoutes {
+		return nil
+	}
+	var table routeTable
+	err := json.Unmarshal(data, &table)
+	if err != nil {
+		return err
+	}
+	mux.Lock()
+	setRoutes(table)
+	syncRoutedServiceStreams()
+	mux.Unlock()
+	saveServiceCache()
+	return nil
+}
+
+// cancel the update streams of the routed services by service name, guarded by mux
+var routedServiceStreams = make(map[string]context.CancelFunc)
+
+// syncRoutedServiceStreams subscribes to the updates of every routed service
+// and ends the streams of services no longer routed to. mux must be held.
+func syncRoutedServiceStreams() {
+	for name, s := range routedServices {
+		if _, ok := routedServiceStreams[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		routedServiceStreams[name] = cancel
+		go serviceStreamJob(ctx, name, s)
+	}
+	for name, cancel := range routedServiceStreams {
+		if _, ok := routedServices[name]; !ok {
+			cancel()
+			delete(routedServiceStreams, name)
+			serviceVersionGauge.DeleteLabelValues(name)
+		}
+	}
+}
+
+// applyBackendsDelta returns a new backend list, setService moves the runtime state over to it
+func applyBackendsDelta(backends []*BackendServer, delta backendsDelta) []*BackendServer {
+	removed := make(map[string]bool, len(delta.Removed))
+	for _, containerName := range delta.Removed {
+		removed[containerName] = true
+	}
+	changed := make(map[string]*BackendServer, len(delta.Backends))
+	for _, backend := range delta.Backends {
+		changed[backend.ContainerName] = backend
+	}
+	updated := make([]*BackendServer, 0, len(backends)+len(delta.Backends))
+	for _, backend := range backends {
+		if removed[backend.ContainerName] {
+			continue
+		}
+		if changedBackend, ok := changed[backend.ContainerName]; ok {
+			updated = append(updated, changedBackend)
+			delete(changed, backend.ContainerName)
+			continue
+		}
+		updated = append(updated, backend)
+	}
+	for _, backend := range delta.Backends {
+		if _, ok := changed[backend.ContainerName]; ok {
+			updated = append(updated, backend)
+		}
+	}
+	return updated
+}
+
+// ackServiceVersion tells the orchestrator which version this load balancer serves
+func ackServiceVersion(serviceName string, version uint64) {
+	dat, err := json.Marshal(map[string]interface{}{
+		"service":      serviceName,
+		"loadBalancer": os.Getenv("CONTAINER_NAME"),
+		"version":      version,
+	})
+	if err != nil {
+		return
+	}
+	httpClient := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := httpClient.Post(orchestratorURL()+"/api/load-balancers/ack", "application/json", bytes.NewReader(dat))
+	if err != nil {
+		fmt.Println("Error acking service version:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("SERVICE VERSION ACK STATUS CODE NOT 200", "STATUS CODE:", resp.StatusCode)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long /lb-health fails before the listeners close, so the orchestrator stops routing clients here first
+	defaultShutdownDelay = 5
+	// how long in-flight requests get to finish
+	defaultShutdownTimeout = 25
+)
+
+// names of the listeners passed on by the previous process, in the order of their file descriptors starting at 3
+const inheritedListenersEnv = "LB_INHERITED_LISTENERS"
+
+// set once SIGTERM is received, /lb-health fails from then on
+var shuttingDown atomic.Bool
+
+type namedListener struct {
+	name string
+	// a net.Listener or a net.PacketConn
+	socket io.Closer
+}
+
+// every listener of the process, handed to the new process on SIGUSR2
+var listeners []namedListener
+
+// inheritedFile returns the socket the previous process passed on under the name
+func inheritedFile(name string) *os.File {
+	for i, inheritedName := range strings.Split(os.Getenv(inheritedListenersEnv), ",") {
+		if inheritedName == name {
+			return os.NewFile(uintptr(3+i), name)
+		}
+	}
+	return nil
+}
+
+// listen takes over the listener of the previous process when there is one, so no connection is refused during an upgrade
+func listen(name string, addr string) (net.Listener, error) {
+	if file := inheritedFile(name); file != nil {
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err == nil {
+			listeners = append(listeners, namedListener{name: name, socket: listener})
+			return listener, nil
+		}
+		fmt.Println("Error inheriting listener", name, ":", err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listeners = append(listeners, namedListener{name: name, socket: listener})
+	return listener, nil
+}
+
+// listenPacket is listen for UDP, both processes read from the socket until the old one closes it
+func listenPacket(name string, addr string) (net.PacketConn, error) {
+	if file := inheritedFile(name); file != nil {
+		conn, err := net.FilePacketConn(file)
+		file.Close()
+		if err == nil {
+			listeners = append(listeners, namedListener{name: name, socket: conn})
+			return conn, nil
+		}
+		fmt.Println("Error inheriting listener", name, ":", err)
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listeners = append(listeners, namedListener{name: name, socket: conn})
+	return conn, nil
+}
+
+func envSeconds(name string, defaultSeconds int) time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || seconds < 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// shutdowner stops accepting and waits for what is in flight, like http.Server.Shutdown
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// waitForShutdown blocks until the process is asked to stop and then shuts the servers down in order,
+// waiting for their requests to finish.
+// SIGTERM first fails the health check for SHUTDOWN_DELAY seconds, SIGUSR2 hands the listeners to a new
+// process and stops right away since that process already accepts the connections.
+func waitForShutdown(servers ...shutdowner) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	for sig := range signals {
+		if sig == syscall.SIGUSR2 {
+			err := handOffListeners()
+			if err != nil {
+				fmt.Println("Error handing off listeners:", err)
+				continue
+			}
+			fmt.Println("Listeners handed off to a new process, shutting down")
+			break
+		}
+		shuttingDown.Store(true)
+		delay := envSeconds("SHUTDOWN_DELAY", defaultShutdownDelay)
+		fmt.Println("Shutting down, failing health checks for", delay)
+		time.Sleep(delay)
+		break
+	}
+	signal.Stop(signals)
+	stopServiceStream.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), envSeconds("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			fmt.Println("Error shutting down server:", err)
+		}
+	}
+	stopAccessLogWriter()
+	fmt.Println("Shutdown complete")
+}
+
+// handOffListeners starts the current binary again with duplicates of the listening sockets.
+// A container stops with its first process, so this is meant for balancers run under a supervisor.
+func handOffListeners() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(listeners))
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fileListener, ok := l.socket.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.New("listener " + l.name + " can not be handed off")
+		}
+		file, err := fileListener.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, l.name)
+		files = append(files, file)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), inheritedListenersEnv+"="+strings.Join(names, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	return cmd.Start()
+}
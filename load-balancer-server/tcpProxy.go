@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ProtocolTCP = "tcp"
+
+const (
+	// connection pools of databases keep their connections open while idle, so the default is generous
+	defaultTCPIdleTimeout = 3600
+
+	tcpDialTimeout = 5 * time.Second
+	tcpBufferSize  = 32 << 10
+)
+
+// tcpProxy balances whole connections for services in tcp mode, every connection stays with the backend
+// it was first sent to. It uses the same backends, health and outlier data as the HTTP proxy.
+type tcpProxy struct {
+	listener net.Listener
+	closed   atomic.Bool
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+}
+
+type tcpConfig struct {
+	serviceName   string
+	protocol      string
+	containerPort int
+	idleTimeout   time.Duration
+}
+
+func currentTCPConfig() tcpConfig {
+	mux.Lock()
+	defer mux.Unlock()
+	service := &home.service
+	idleTimeout := service.TCPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+	return tcpConfig{
+		serviceName:   service.Name,
+		protocol:      service.Protocol,
+		containerPort: service.ContainerPort,
+		idleTimeout:   time.Duration(idleTimeout) * time.Second,
+	}
+}
+
+func serveTCP(listener net.Listener) *tcpProxy {
+	p := &tcpProxy{
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go p.serve()
+	return p
+}
+
+func (p *tcpProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// running out of file descriptors passes, back off instead of spinning
+			fmt.Println("Error accepting TCP connection:", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !p.track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer p.untrack(conn)
+			handleTCPConnection(&IncomingReq{srcConn: conn, reqId: uuid.NewString()})
+		}()
+	}
+}
+
+func (p *tcpProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.Load() {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *tcpProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+func (p *tcpProxy) activeConnections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// Shutdown stops accepting and waits for the connections to end, the ones still open when ctx is done are closed
+func (p *tcpProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed.Store(true)
+	p.mu.Unlock()
+	err := p.listener.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for p.activeConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			p.mu.Lock()
+			for conn := range p.conns {
+				conn.Close()
+			}
+			p.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func handleTCPConnection(incoming *IncomingReq) {
+	client := incoming.srcConn
+	defer client.Close()
+	config := currentTCPConfig()
+	if config.protocol != ProtocolTCP {
+		return
+	}
+	requests.Add(1)
+	tcpConnectionsActive.WithLabelValues(config.serviceName).Inc()
+	defer tcpConnectionsActive.WithLabelValues(config.serviceName).Dec()
+	backend, upstream := dialBackend(incoming, config)
+	if upstream == nil {
+		fmt.Println("No backend for TCP connection", incoming.reqId, "from", client.RemoteAddr())
+		return
+	}
+	defer upstream.Close()
+	atomic.AddInt64(&backend.numRequests, 1)
+	atomic.AddInt64(&backend.activeRequests, 1)
+	defer atomic.AddInt64(&backend.activeRequests, -1)
+	pipeTCP(client, upstream, config.idleTimeout)
+}
+
+// dialBackend connects to the next backend, a backend that refuses the connection is reported
+// and the next one is tried since nothing was sent to it yet
+func dialBackend(incoming *IncomingReq, config tcpConfig) (*BackendServer, net.Conn) {
+	clientIP := incoming.srcConn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	tried := make(map[string]bool)
+	for {
+		backend := home.pickBackend(tried, func(*Service) string {
+			return clientIP
+		})
+		if backend == nil {
+			return nil, nil
+		}
+		tried[backend.ContainerName] = true
+		upstream, err := net.DialTimeout("tcp", net.JoinHostPort(backend.ContainerName, strconv.Itoa(config.containerPort)), tcpDialTimeout)
+		if err != nil {
+			fmt.Println("Error connecting to", backend.ContainerName, "for TCP connection", incoming.reqId, ":", err)
+			upstreamErrorsTotal.WithLabelValues(config.serviceName, backend.ContainerName).Inc()
+			home.reportUpstreamResult(backend, false)
+			continue
+		}
+		home.reportUpstreamResult(backend, true)
+		return backend, upstream
+	}
+}
+
+// pipeTCP copies both directions until both ended. The end of one direction is passed on as a half-close,
+// so a client can finish sending and still read the reply. Both connections are closed after idleTimeout
+// without data in either direction.
+func pipeTCP(client net.Conn, upstream net.Conn, idleTimeout time.Duration) {
+	idle := time.AfterFunc(idleTimeout, func() {
+		client.Close()
+		upstream.Close()
+	})
+	defer idle.Stop()
+	done := make(chan struct{})
+	go func() {
+		copyHalf(upstream, client, idle, idleTimeout)
+		close(done)
+	}()
+	copyHalf(client, upstream, idle, idleTimeout)
+	<-done
+}
+
+func copyHalf(dst net.Conn, src net.Conn, idle *time.Timer, idleTimeout time.Duration) {
+	buf := make([]byte, tcpBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			idle.Reset(idleTimeout)
+			_, writeErr := dst.Write(buf[:n])
+			if writeErr != nil {
+				// the other direction can not go on either
+				src.Close()
+				dst.Close()
+				return
+			}
+		}
+		if err == io.EOF {
+			closeWrite(dst)
+			return
+		}
+		if err != nil {
+			src.Close()
+			dst.Close()
+			return
+		}
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
+		return
+	}
+	conn.Close()
+}
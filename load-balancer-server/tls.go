@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Certificate struct {
+	ID        uint   `json:"id"`
+	ServiceID uint   `json:"serviceId"`
+	Hostnames string `json:"hostnames"`
+	CertPEM   string `json:"certPem"`
+	KeyPEM    string `json:"keyPem"`
+}
+
+// certificateStore picks the certificate for a TLS handshake by SNI. The certificates are swapped
+// as a whole whenever the service changes, so handshakes never wait on an update.
+type certificateStore struct {
+	certificates atomic.Pointer[certificateSet]
+}
+
+type certificateSet struct {
+	byHostname map[string]*tls.Certificate
+	// served to clients that send no SNI or a hostname without a certificate
+	fallback *tls.Certificate
+}
+
+var certificates certificateStore
+
+// where the orchestrator mounts the certificate of the container, signed by its internal CA
+const defaultUpstreamCertDir = "/certs"
+
+func (s *certificateStore) update(serviceCertificates []Certificate) {
+	set := &certificateSet{byHostname: make(map[string]*tls.Certificate)}
+	for _, certificate := range serviceCertificates {
+		if certificate.KeyPEM == "" {
+			// a load balancer booted from its cache has no keys until it fetches them from the orchestrator
+			continue
+		}
+		pair, err := tls.X509KeyPair([]byte(certificate.CertPEM), []byte(certificate.KeyPEM))
+		if err != nil {
+			fmt.Println("Error loading certificate", certificate.ID, ":", err)
+			continue
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			fmt.Println("Error parsing certificate", certificate.ID, ":", err)
+			continue
+		}
+		pair.Leaf = leaf
+		hostnames := leaf.DNSNames
+		if certificate.Hostnames != "" {
+			hostnames = strings.Split(certificate.Hostnames, ",")
+		}
+		for _, hostname := range hostnames {
+			set.byHostname[strings.ToLower(strings.TrimSpace(hostname))] = &pair
+		}
+		if set.fallback == nil {
+			set.fallback = &pair
+		}
+	}
+	s.certificates.Store(set)
+}
+
+func (s *certificateStore) available() bool {
+	set := s.certificates.Load()
+	return set != nil && set.fallback != nil
+}
+
+// get matches the exact hostname first and then a wildcard certificate for its parent domain
+func (s *certificateStore) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.certificates.Load()
+	if set == nil || set.fallback == nil {
+		return nil, errors.New("no certificate configured")
+	}
+	serverName := strings.ToLower(hello.ServerName)
+	if certificate, ok := set.byHostname[serverName]; ok {
+		return certificate, nil
+	}
+	if i := strings.Index(serverName, "."); i > 0 {
+		if certificate, ok := set.byHostname["*"+serverName[i:]]; ok {
+			return certificate, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: certificates.get,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// upstreamTLSConfig authenticates the load balancer to the backends with the certificate of its container
+// and only trusts backends with a certificate from the same CA
+func upstreamTLSConfig() (*tls.Config, error) {
+	dir := os.Getenv("UPSTREAM_CERT_DIR")
+	if dir == "" {
+		dir = defaultUpstreamCertDir
+	}
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no CA certificate in " + filepath.Join(dir, "ca.pem"))
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		RootCAs:      roots,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// the orchestrator only hands out the keys of the certificates over mutual TLS, to load balancers
+// authenticated with the certificate of their container
+const defaultCertificateKeysURL = "https://host.docker.internal:3443"
+
+// the name in the certificate of the orchestrator, whatever host it is reached on
+const orchestratorServerName = "orchestrator"
+
+func certificateKeysURL() string {
+	keysURL := os.Getenv("ORCHESTRATOR_KEYS_URL")
+	if keysURL == "" {
+		return defaultCertificateKeysURL
+	}
+	return strings.TrimSuffix(keysURL, "/")
+}
+
+// loadCertificateKeys fills in the keys of the certificates of a service update, which come without them.
+// Keys of certificates the service already had are kept, the others are fetched from the orchestrator.
+func (s *balancedService) loadCertificateKeys(serviceName string, serviceCertificates []Certificate) error {
+	mux.Lock()
+	known := make(map[uint]Certificate, len(s.service.Certificates))
+	for _, certificate := range s.service.Certificates {
+		known[certificate.ID] = certificate
+	}
+	mux.Unlock()
+	missing := false
+	for i := range serviceCertificates {
+		certificate := &serviceCertificates[i]
+		if previous, ok := known[certificate.ID]; ok && previous.CertPEM == certificate.CertPEM && certificate.KeyPEM == "" {
+			certificate.KeyPEM = previous.KeyPEM
+		}
+		missing = missing || certificate.KeyPEM == ""
+	}
+	if !missing {
+		return nil
+	}
+	keys, err := fetchCertificateKeys(serviceName)
+	if err != nil {
+		return fmt.Errorf("fetching certificate keys: %w", err)
+	}
+	for i := range serviceCertificates {
+		if key, ok := keys[serviceCertificates[i].ID]; ok {
+			serviceCertificates[i].KeyPEM = key
+		}
+	}
+	return nil
+}
+
+// fetchCertificateKeys returns the keys of the certificates of the service by certificate id
+func fetchCertificateKeys(serviceName string) (map[uint]string, error) {
+	config, err := upstreamTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = orchestratorServerName
+	httpClient := http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+	resp, err := httpClient.Get(certificateKeysURL() + "/api/load-balancers/certificate-keys?" + url.Values{"service": {serviceName}}.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var body []struct {
+		ID     uint   `json:"id"`
+		KeyPEM string `json:"keyPem"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[uint]string, len(body))
+	for _, key := range body {
+		keys[key.ID] = key.KeyPEM
+	}
+	return keys, nil
+}
+
+// withoutKeys copies the certificates without their private keys
+func withoutKeys(serviceCertificates []Certificate) []Certificate {
+	if serviceCertificates == nil {
+		return nil
+	}
+	stripped := make([]Certificate, len(serviceCertificates))
+	for i, certificate := range serviceCertificates {
+		certificate.KeyPEM = ""
+		stripped[i] = certificate
+	}
+	return stripped
+}
+
+// redirectToHTTPS sends plain HTTP clients to the TLS listener when the service the request is routed to asks for it.
+// TLS_PORT is the port the TLS listener is published on, it is left out of the location when it is 443.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request, target *balancedService) bool {
+	if r.TLS != nil || !target.tlsRedirect() || !certificates.available() {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	port := os.Getenv("TLS_PORT")
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	return true
+}
+
+func forwardedProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+)
+
+var tracer = otel.Tracer("load-balancer-server")
+
+// initTracing sets up the span exporter picked by TRACE_EXPORTER, tracing is a no-op when it is unset.
+// The otlp exporter reads its endpoint from OTEL_EXPORTER_OTLP_ENDPOINT, the file exporter writes to TRACE_FILE.
+// The returned function flushes the spans that are still buffered.
+func initTracing() func() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	exporter, err := newTraceExporter()
+	if err != nil {
+		fmt.Println("Error creating trace exporter:", err)
+		return func() {}
+	}
+	if exporter == nil {
+		return func() {}
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("load-balancer-server"),
+			attribute.String("container.name", os.Getenv("CONTAINER_NAME")),
+			attribute.String("lb.service", os.Getenv("SERVICE_NAME")),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := provider.Shutdown(ctx)
+		if err != nil {
+			fmt.Println("Error flushing traces:", err)
+		}
+	}
+}
+
+func newTraceExporter() (sdktrace.SpanExporter, error) {
+	switch os.Getenv("TRACE_EXPORTER") {
+	case TraceExporterOTLP:
+		return otlptracehttp.New(context.Background())
+	case TraceExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterFile:
+		file, err := os.OpenFile(os.Getenv("TRACE_FILE"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	}
+	return nil, nil
+}
+
+// startProxySpan starts the span of a client request, continuing the trace of its traceparent header
+func startProxySpan(r *http.Request, serviceName string, requestID string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "proxy",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			attribute.String("lb.service", serviceName),
+			attribute.String("request.id", requestID),
+		))
+	return r.WithContext(ctx), span
+}
+
+// startAttemptSpan starts the span of one attempt against a backend and passes it on in the traceparent header
+func startAttemptSpan(r *http.Request, backend *BackendServer, attempt int) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(r.Context(), "upstream attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("backend.container", backend.ContainerName),
+			attribute.Int("attempt", attempt),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+	return r.WithContext(ctx), span
+}
+
+func endSpan(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ProtocolUDP = "udp"
+
+const (
+	defaultUDPIdleTimeout = 30
+
+	// the largest datagram UDP can carry
+	udpBufferSize      = 64 << 10
+	udpExpiryInterval  = time.Second
+	udpFlowDialTimeout = 5 * time.Second
+	// datagrams of a client waiting for its flow to reach the backend, more are dropped
+	udpFlowQueueSize = 64
+	// clients beyond it are dropped until flows expire, every flow holds a socket
+	udpMaxFlows = 10000
+)
+
+// udpProxy forwards datagrams for services in udp mode. Every client address gets a flow with its own socket
+// to the backend it was balanced to, so replies find their way back and the client keeps its backend
+// until the flow is idle for the idle timeout.
+type udpProxy struct {
+	conn   net.PacketConn
+	closed atomic.Bool
+	mu     sync.Mutex
+	flows  map[string]*udpFlow
+}
+
+type udpFlow struct {
+	key          string
+	client       net.Addr
+	serviceName  string
+	backend      *BackendServer
+	outbound     chan []byte
+	done         chan struct{}
+	lock         sync.Mutex
+	upstream     net.Conn
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+}
+
+type udpConfig struct {
+	serviceName   string
+	protocol      string
+	containerPort int
+	idleTimeout   time.Duration
+}
+
+func currentUDPConfig() udpConfig {
+	mux.Lock()
+	defer mux.Unlock()
+	service := &home.service
+	idleTimeout := service.UDPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	return udpConfig{
+		serviceName:   service.Name,
+		protocol:      service.Protocol,
+		containerPort: service.ContainerPort,
+		idleTimeout:   time.Duration(idleTimeout) * time.Second,
+	}
+}
+
+func serveUDP(conn net.PacketConn) *udpProxy {
+	p := &udpProxy{
+		conn:  conn,
+		flows: make(map[string]*udpFlow),
+	}
+	go p.serve()
+	go p.expireFlows()
+	return p
+}
+
+func (p *udpProxy) serve() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := p.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Error reading UDP datagram:", err)
+			continue
+		}
+		config := currentUDPConfig()
+		if config.protocol != ProtocolUDP {
+			continue
+		}
+		flow := p.flow(client, config)
+		if flow == nil {
+			// dropped, the client retries like it would for any lost datagram
+			continue
+		}
+		requests.Add(1)
+		atomic.AddInt64(&flow.backend.numRequests, 1)
+		flow.lastActivity.Store(time.Now().UnixNano())
+		select {
+		case flow.outbound <- append([]byte(nil), buf[:n]...):
+		default:
+			// the backend does not keep up, the datagram is lost
+		}
+	}
+}
+
+// flow returns the flow of the client address, a new client is balanced to a backend.
+// The flow dials the backend on its own goroutine, so a slow backend does not hold up the other clients.
+func (p *udpProxy) flow(client net.Addr, config udpConfig) *udpFlow {
+	key := client.String()
+	p.mu.Lock()
+	flow, ok := p.flows[key]
+	full := len(p.flows) >= udpMaxFlows
+	p.mu.Unlock()
+	if ok {
+		return flow
+	}
+	if full {
+		return nil
+	}
+	clientIP := key
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		clientIP = host
+	}
+	backend := home.pickBackend(nil, func(*Service) string {
+		return clientIP
+	})
+	if backend == nil {
+		return nil
+	}
+	flow = &udpFlow{
+		key:         key,
+		client:      client,
+		serviceName: config.serviceName,
+		backend:     backend,
+		outbound:    make(chan []byte, udpFlowQueueSize),
+		done:        make(chan struct{}),
+	}
+	flow.lastActivity.Store(time.Now().UnixNano())
+	p.mu.Lock()
+	if p.closed.Load() {
+		p.mu.Unlock()
+		releaseUpstream(backend)
+		return nil
+	}
+	p.flows[key] = flow
+	p.mu.Unlock()
+	atomic.AddInt64(&backend.activeRequests, 1)
+	udpFlowsActive.WithLabelValues(config.serviceName).Inc()
+	go p.forward(flow, net.JoinHostPort(backend.ContainerName, strconv.Itoa(config.containerPort)))
+	return flow
+}
+
+// forward dials the backend and writes the datagrams of the client to it until the flow ends
+func (p *udpProxy) forward(flow *udpFlow, addr string) {
+	upstream, err := net.DialTimeout("udp", addr, udpFlowDialTimeout)
+	if err != nil {
+		p.remove(flow, err)
+		return
+	}
+	flow.lock.Lock()
+	select {
+	case <-flow.done:
+		// removed while dialing
+		flow.lock.Unlock()
+		upstream.Close()
+		return
+	default:
+	}
+	flow.upstream = upstream
+	flow.lock.Unlock()
+	go p.relayReplies(flow)
+	for {
+		select {
+		case <-flow.done:
+			return
+		case datagram := <-flow.outbound:
+			_, err = upstream.Write(datagram)
+			if err != nil {
+				p.remove(flow, err)
+				return
+			}
+		}
+	}
+}
+
+// relayReplies sends what the backend answers back to the client from the address the client sent to
+func (p *udpProxy) relayReplies(flow *udpFlow) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := flow.upstream.Read(buf)
+		if err != nil {
+			// a closed flow ends quietly, anything else such as a refused port means the backend is gone
+			if !errors.Is(err, net.ErrClosed) {
+				p.remove(flow, err)
+			}
+			return
+		}
+		flow.lastActivity.Store(time.Now().UnixNano())
+		_, err = p.conn.WriteTo(buf[:n], flow.client)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Error sending UDP reply to", flow.client, ":", err)
+		}
+	}
+}
+
+// remove ends the flow, the next datagram of the client starts a new one. A flow ending without an error
+// tells nothing about its backend, UDP has no response to judge by.
+func (p *udpProxy) remove(flow *udpFlow, err error) {
+	p.mu.Lock()
+	if p.flows[flow.key] == flow {
+		delete(p.flows, flow.key)
+	}
+	p.mu.Unlock()
+	flow.closeOnce.Do(func() {
+		flow.lock.Lock()
+		close(flow.done)
+		if flow.upstream != nil {
+			flow.upstream.Close()
+		}
+		flow.lock.Unlock()
+		atomic.AddInt64(&flow.backend.activeRequests, -1)
+		udpFlowsActive.WithLabelValues(flow.serviceName).Dec()
+		if err != nil {
+			fmt.Println("UDP flow of", flow.client, "to", flow.backend.ContainerName, "failed:", err)
+			upstreamErrorsTotal.WithLabelValues(flow.serviceName, flow.backend.ContainerName).Inc()
+			home.reportUpstreamResult(flow.backend, false)
+			return
+		}
+		releaseUpstream(flow.backend)
+	})
+}
+
+// expireFlows ends idle flows, and flows to backends that are no longer healthy so their clients move on.
+// Flows to draining backends go on until they are idle.
+func (p *udpProxy) expireFlows() {
+	ticker := time.NewTicker(udpExpiryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if p.closed.Load() {
+			return
+		}
+		idleSince := time.Now().Add(-currentUDPConfig().idleTimeout).UnixNano()
+		p.mu.Lock()
+		var expired []*udpFlow
+		for _, flow := range p.flows {
+			if flow.lastActivity.Load() < idleSince || !isServing(flow.backend) {
+				expired = append(expired, flow)
+			}
+		}
+		p.mu.Unlock()
+		for _, flow := range expired {
+			p.remove(flow, nil)
+		}
+	}
+}
+
+// isServing tells whether the backend is still a healthy part of the service
+func isServing(backend *BackendServer) bool {
+	mux.Lock()
+	defer mux.Unlock()
+	for _, b := range home.service.Backends {
+		if b == backend {
+			return b.IsHealthy
+		}
+	}
+	return false
+}
+
+// Shutdown closes the socket and all flows right away, a datagram in flight is lost like any other.
+// After a handoff the new process has its own copy of the socket and takes over the clients.
+func (p *udpProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed.Store(true)
+	flows := make([]*udpFlow, 0, len(p.flows))
+	for _, flow := range p.flows {
+		flows = append(flows, flow)
+	}
+	p.mu.Unlock()
+	for _, flow := range flows {
+		p.remove(flow, nil)
+	}
+	err := p.conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -1,12 +1,32 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"io"
 	"net/http"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
+var balancingStrategies = []string{"", "round-robin", "least-connections", "power-of-two-choices", "weighted-round-robin", "random", "consistent-hash"}
+
+var serviceProtocols = []string{"", "http", "grpc", "tcp", "udp"}
+
+var hashKeySources = []string{"", "client-ip", "header", "cookie"}
+
+var accessLogFormats = []string{"", "json", "logfmt"}
+
+var accessLogLevels = []string{"", "off", "error", "info"}
+
+var accessLogFields = []string{"method", "path", "status", "bytes", "upstream", "upstream_latency", "latency", "client_ip", "request_id", "retries"}
+
 func apis() {
 	router := gin.Default()
 	apis := router.Group("/api")
@@ -29,6 +49,45 @@ func apis() {
 		apis.GET("/service/:id/load-balancers", func(context *gin.Context) {
 			getServiceLoadBalancers(context)
 		})
+		apis.PATCH("/service/:id/backends/:backendId", func(context *gin.Context) {
+			updateBackendWeight(context)
+		})
+		apis.GET("/service/:id/certificates", func(context *gin.Context) {
+			getCertificates(context)
+		})
+		apis.POST("/service/:id/certificates", func(context *gin.Context) {
+			addCertificate(context)
+		})
+		apis.DELETE("/service/:id/certificates/:certificateId", func(context *gin.Context) {
+			deleteCertificate(context)
+		})
+		apis.GET("/service/:id/sync-status", func(context *gin.Context) {
+			getServiceSyncStatusHandler(context)
+		})
+		apis.GET("/load-balancers/stream", func(context *gin.Context) {
+			streamServiceUpdates(context)
+		})
+		apis.POST("/load-balancers/ack", func(context *gin.Context) {
+			ackServiceUpdate(context)
+		})
+		apis.POST("/load-balancers/rate-limits", func(context *gin.Context) {
+			syncRateLimit(context)
+		})
+		apis.GET("/load-balancers/routes/stream", func(context *gin.Context) {
+			streamRouteUpdates(context)
+		})
+		apis.GET("/routes", func(context *gin.Context) {
+			getRoutes(context)
+		})
+		apis.POST("/routes", func(context *gin.Context) {
+			createRoute(context)
+		})
+		apis.PUT("/routes/:id", func(context *gin.Context) {
+			updateRoute(context)
+		})
+		apis.DELETE("/routes/:id", func(context *gin.Context) {
+			deleteRoute(context)
+		})
 	}
 	router.Run(":3000")
 }
@@ -42,6 +101,14 @@ func createService(c *gin.Context) {
 		})
 		return
 	}
+	if err := validateService(&service); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	// certificates are managed through their own endpoints
+	service.Certificates = nil
 
 	err := db.Save(&service).Error
 	if err != nil {
@@ -103,6 +170,15 @@ func updateService(c *gin.Context) {
 		return
 	}
 
+	if err := validateService(&service); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	// certificates are managed through their own endpoints
+	service.Certificates = nil
+
 	service.ID = uint(id)
 
 	err = db.Save(&service).Error
@@ -112,6 +188,17 @@ func updateService(c *gin.Context) {
 		})
 		return
 	}
+	if service.Name != findService.Name {
+		// routes follow the service when it is renamed
+		err = db.Model(&Route{}).Where("service = ?", findService.Name).Update("service", service.Name).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		go publishRoutes()
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"message": "service updated",
 	})
@@ -137,11 +224,20 @@ func deleteService(c *gin.Context) {
 		})
 		return
 	}
+	// routes to a deleted service would only ever answer 503
+	err = db.Where("service = ?", findService.Name).Delete(&Route{}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"message": "service deleted",
 	})
 
 	go reloadServices()
+	go publishRoutes()
 }
 
 func getServiceLoadBalancers(c *gin.Context) {
@@ -164,3 +260,387 @@ func getServiceLoadBalancers(c *gin.Context) {
 		"error": "Service not found",
 	})
 }
+
+func updateBackendWeight(c *gin.Context) {
+	id := c.Param("id")
+	backendId := c.Param("backendId")
+	var body struct {
+		Weight int `json:"weight"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if body.Weight < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Weight must be at least 1",
+		})
+		return
+	}
+	var backend BackendServer
+	err := db.First(&backend, "id = ? AND service_id = ?", backendId, id).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Backend not found",
+		})
+		return
+	}
+	err = db.Model(&backend).Update("weight", body.Weight).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, service := range services {
+		if service.ID == backend.ServiceID {
+			for _, b := range service.Backends {
+				if b.ID == backend.ID {
+					b.Weight = body.Weight
+				}
+			}
+			publishServiceUpdate(service)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "backend updated",
+	})
+}
+
+// CertificateInfo describes a stored certificate without its private key
+type CertificateInfo struct {
+	ID        uint      `json:"id"`
+	Hostnames string    `json:"hostnames"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+func getCertificates(c *gin.Context) {
+	id := c.Param("id")
+	var certificates []Certificate
+	err := db.Find(&certificates, "service_id = ?", id).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	infos := make([]CertificateInfo, 0, len(certificates))
+	for _, certificate := range certificates {
+		info := CertificateInfo{ID: certificate.ID, Hostnames: certificate.Hostnames}
+		if leaf, err := parseCertificate(&certificate); err == nil {
+			info.NotAfter = leaf.NotAfter
+		}
+		infos = append(infos, info)
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+func addCertificate(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid ID",
+		})
+		return
+	}
+	var findService Service
+	err = db.First(&findService, id).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Service not found",
+		})
+		return
+	}
+	var certificate Certificate
+	if err := c.BindJSON(&certificate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	certificate.ID = 0
+	certificate.ServiceID = uint(id)
+	leaf, err := parseCertificate(&certificate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if certificate.Hostnames == "" {
+		certificate.Hostnames = strings.Join(leaf.DNSNames, ",")
+	}
+	if certificate.Hostnames == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "certificate has no DNS names, hostnames is required",
+		})
+		return
+	}
+	err = db.Save(&certificate).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, service := range services {
+		if service.ID == certificate.ServiceID {
+			service.Certificates = append(service.Certificates, &certificate)
+			publishServiceUpdate(service)
+		}
+	}
+	c.JSON(http.StatusOK, CertificateInfo{ID: certificate.ID, Hostnames: certificate.Hostnames, NotAfter: leaf.NotAfter})
+}
+
+func deleteCertificate(c *gin.Context) {
+	id := c.Param("id")
+	certificateId := c.Param("certificateId")
+	var certificate Certificate
+	err := db.First(&certificate, "id = ? AND service_id = ?", certificateId, id).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Certificate not found",
+		})
+		return
+	}
+	err = db.Delete(&certificate).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, service := range services {
+		if service.ID == certificate.ServiceID {
+			service.Certificates = slices.DeleteFunc(service.Certificates, func(cert *Certificate) bool {
+				return cert.ID == certificate.ID
+			})
+			publishServiceUpdate(service)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "certificate deleted",
+	})
+}
+
+// parseCertificate checks that the key matches the certificate and returns the leaf certificate
+func parseCertificate(certificate *Certificate) (*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair([]byte(certificate.CertPEM), []byte(certificate.KeyPEM))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(pair.Certificate[0])
+}
+
+func getServiceSyncStatusHandler(c *gin.Context) {
+	id := c.Param("id")
+	for _, service := range services {
+		if strconv.Itoa(int(service.ID)) == id {
+			c.JSON(http.StatusOK, getServiceSyncStatus(service))
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Service not found",
+	})
+}
+
+// streamServiceUpdates keeps a server-sent events stream open to a load balancer, starting with a snapshot
+// of its service and followed by every update published for it
+func streamServiceUpdates(c *gin.Context) {
+	serviceName := c.Query("service")
+	loadBalancer := c.Query("loadBalancer")
+	var service *Service
+	for _, s := range services {
+		if s.Name == serviceName {
+			service = s
+		}
+	}
+	if service == nil || loadBalancer == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Service not found",
+		})
+		return
+	}
+	publisher := getPublisher(serviceName)
+	// makes sure there is a snapshot to start from
+	publisher.publish(service)
+	events, snapshot := publisher.subscribe(loadBalancer)
+	defer publisher.unsubscribe(loadBalancer, events)
+	streamEvents(c, events, snapshot)
+}
+
+// streamEvents writes the snapshot and then every event until the subscription or the request ends,
+// with a heartbeat while there is nothing to send
+func streamEvents(c *gin.Context, events chan serviceEvent, snapshot serviceEvent) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	if writeServiceEvent(c.Writer, snapshot) != nil {
+		return
+	}
+	c.Writer.Flush()
+	heartbeat := time.NewTicker(serviceStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if writeServiceEvent(c.Writer, event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func ackServiceUpdate(c *gin.Context) {
+	var body struct {
+		Service      string `json:"service"`
+		LoadBalancer string `json:"loadBalancer"`
+		Version      uint64 `json:"version"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	found := false
+	for _, service := range services {
+		if service.Name == body.Service {
+			found = true
+		}
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Service not found",
+		})
+		return
+	}
+	getPublisher(body.Service).ack(body.LoadBalancer, body.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ack received",
+	})
+}
+
+func validateService(service *Service) error {
+	if !slices.Contains(balancingStrategies, service.Strategy) {
+		return fmt.Errorf("unknown strategy %s", service.Strategy)
+	}
+	if !slices.Contains(serviceProtocols, service.Protocol) {
+		return fmt.Errorf("unknown protocol %s", service.Protocol)
+	}
+	if !slices.Contains(hashKeySources, service.HashKeySource) {
+		return fmt.Errorf("unknown hash key source %s", service.HashKeySource)
+	}
+	if (service.HashKeySource == "header" || service.HashKeySource == "cookie") && service.HashKeyName == "" {
+		return fmt.Errorf("hashKeyName is required for hash key source %s", service.HashKeySource)
+	}
+	if service.OutlierErrorRatePercent < 0 || service.OutlierErrorRatePercent > 100 {
+		return fmt.Errorf("outlierErrorRatePercent must be between 0 and 100")
+	}
+	if service.OutlierMaxEjectionPercent < 0 || service.OutlierMaxEjectionPercent > 100 {
+		return fmt.Errorf("outlierMaxEjectionPercent must be between 0 and 100")
+	}
+	if service.TCPIdleTimeout < 0 {
+		return fmt.Errorf("tcpIdleTimeout must not be negative")
+	}
+	if service.UDPIdleTimeout < 0 {
+		return fmt.Errorf("udpIdleTimeout must not be negative")
+	}
+	if _, err := hex.DecodeString(service.UDPHealthProbe); err != nil {
+		return fmt.Errorf("udpHealthProbe must be hex encoded")
+	}
+	if service.Protocol == "udp" && service.UDPHealthProbe == "" && service.HealthEndpoint == "" {
+		return fmt.Errorf("udp services need a udpHealthProbe or a healthEndpoint")
+	}
+	if service.RateLimitPerSecond < 0 {
+		return fmt.Errorf("rateLimitPerSecond must not be negative")
+	}
+	if service.RateLimitBurst < 0 {
+		return fmt.Errorf("rateLimitBurst must not be negative")
+	}
+	if !slices.Contains(rateLimitKeys, service.RateLimitKey) {
+		return fmt.Errorf("unknown rate limit key %s", service.RateLimitKey)
+	}
+	if service.RateLimitKey == "header" && service.RateLimitHeader == "" {
+		return fmt.Errorf("rateLimitHeader is required for rate limit key header")
+	}
+	if service.MaxInFlight < 0 {
+		return fmt.Errorf("maxInFlight must not be negative")
+	}
+	if service.ConcurrencyQueueSize < 0 {
+		return fmt.Errorf("concurrencyQueueSize must not be negative")
+	}
+	if service.ConcurrencyQueueTimeoutMs < 0 {
+		return fmt.Errorf("concurrencyQueueTimeoutMs must not be negative")
+	}
+	if service.CacheMemoryMB < 0 {
+		return fmt.Errorf("cacheMemoryMb must not be negative")
+	}
+	if service.CacheMaxObjectKB < 0 {
+		return fmt.Errorf("cacheMaxObjectKb must not be negative")
+	}
+	if service.CacheDiskMB < 0 {
+		return fmt.Errorf("cacheDiskMb must not be negative")
+	}
+	// the load balancers keep it below their cache root
+	if service.CacheDiskDir != "" && !filepath.IsLocal(service.CacheDiskDir) {
+		return fmt.Errorf("cacheDiskDir must be a relative path without ..")
+	}
+	if service.DrainTimeout < 0 {
+		return fmt.Errorf("drainTimeout must not be negative")
+	}
+	if service.RetryMaxAttempts < 0 {
+		return fmt.Errorf("retryMaxAttempts must not be negative")
+	}
+	if service.RetryBudgetPercent < 0 || service.RetryBudgetPercent > 100 {
+		return fmt.Errorf("retryBudgetPercent must be between 0 and 100")
+	}
+	if service.CircuitErrorRatePercent < 0 || service.CircuitErrorRatePercent > 100 {
+		return fmt.Errorf("circuitErrorRatePercent must be between 0 and 100")
+	}
+	if !slices.Contains(accessLogFormats, service.AccessLogFormat) {
+		return fmt.Errorf("unknown access log format %s", service.AccessLogFormat)
+	}
+	if !slices.Contains(accessLogLevels, service.AccessLogLevel) {
+		return fmt.Errorf("unknown access log level %s", service.AccessLogLevel)
+	}
+	if service.AccessLogSampleRate < 0 || service.AccessLogSampleRate > 1 {
+		return fmt.Errorf("accessLogSampleRate must be between 0 and 1")
+	}
+	if service.AccessLogFields != "" {
+		for _, field := range strings.Split(service.AccessLogFields, ",") {
+			if !slices.Contains(accessLogFields, strings.TrimSpace(field)) {
+				return fmt.Errorf("unknown access log field %s", field)
+			}
+		}
+	}
+	if service.RetryOnStatus != "" {
+		for _, status := range strings.Split(service.RetryOnStatus, ",") {
+			if _, err := strconv.Atoi(strings.TrimSpace(status)); err != nil {
+				return fmt.Errorf("invalid status %s in retryOnStatus", status)
+			}
+		}
+	}
+	if service.RetryOnGRPCStatus != "" {
+		for _, status := range strings.Split(service.RetryOnGRPCStatus, ",") {
+			if _, err := strconv.Atoi(strings.TrimSpace(status)); err != nil {
+				return fmt.Errorf("invalid status %s in retryOnGrpcStatus", status)
+			}
+		}
+	}
+	return validateRewriteRules(service.Rewrite)
+}
@@ -1,13 +1,35 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"strings"
 )
 
-func runBackendServer(backend *BackendServer, service *Service) (bool, error) {
-	_, err := runCommand("start backend server", fmt.Sprintf("docker run -e CONTAINER_NAME=%s -d -p %d:%d --network load-balancer-network --name %s %s", backend.ContainerName, backend.Port, service.ContainerPort, backend.ContainerName, service.ContainerImageName))
+func runBackendServer(ctx context.Context, backend *BackendServer, service *Service) (bool, error) {
+	_, span := tracer.Start(ctx, "runBackendServer", trace.WithAttributes(
+		attribute.String("lb.service", service.Name),
+		attribute.String("container.name", backend.ContainerName),
+	))
+	tlsFlags := ""
+	if service.UpstreamTLS {
+		certsFlag, err := certsVolumeFlag(backend.ContainerName)
+		if err != nil {
+			endSpan(span, err)
+			return false, err
+		}
+		tlsFlags = certsFlag + " -e TLS_DIR=/certs"
+	}
+	// the health check probes udp mode backends from the host
+	portFlags := fmt.Sprintf("-p %d:%d", backend.Port, service.ContainerPort)
+	if service.Protocol == "udp" {
+		portFlags += fmt.Sprintf(" -p %d:%d/udp", backend.Port, service.ContainerPort)
+	}
+	_, err := runCommand("start backend server", fmt.Sprintf("docker run -e CONTAINER_NAME=%s%s%s -d %s --network load-balancer-network --name %s %s", backend.ContainerName, traceEnvFlags(), tlsFlags, portFlags, backend.ContainerName, service.ContainerImageName))
+	endSpan(span, err)
 	if err != nil {
 		return false, errors.New("error running docker container")
 	} else {
@@ -16,7 +38,11 @@ func runBackendServer(backend *BackendServer, service *Service) (bool, error) {
 	return true, nil
 }
 
-func stopBackendServer(backend *BackendServer) {
+func stopBackendServer(ctx context.Context, backend *BackendServer) {
+	_, span := tracer.Start(ctx, "stopBackendServer", trace.WithAttributes(
+		attribute.String("container.name", backend.ContainerName),
+	))
+	defer span.End()
 	_, errStop := runCommand("stop backend server", fmt.Sprintf("docker stop %s", backend.ContainerName))
 	if errStop != nil {
 		fmt.Println(errStop)
@@ -26,6 +52,7 @@ func stopBackendServer(backend *BackendServer) {
 	if errDel != nil {
 		fmt.Println(errDel)
 	}
+	removeContainerCertificates(backend.ContainerName)
 	db.Delete(&BackendServer{}, "id = ?", backend.ID)
 }
 
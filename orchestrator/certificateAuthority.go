@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CertificateAuthority signs the certificates of the containers, it is stored in the database
+// so every orchestrator node issues certificates the running containers trust.
+// KeyPEM is encrypted with the secret from caKeySecret, the database alone does not give away the key.
+type CertificateAuthority struct {
+	ID      uint
+	CertPEM string
+	KeyPEM  string
+}
+
+// where the certificates of the containers are written on the host, mounted into each container at /certs
+var containerCertsDir = filepath.Join(os.TempDir(), "load-balancer-certs")
+
+// the nonroot user of the images the containers run, the only user that can read their keys.
+// CONTAINER_CERTS_UID sets another one for images running as a different user.
+const defaultContainerCertsUID = 65532
+
+// prefix of an encrypted CA key, keys stored before encryption are plain PEM and get encrypted on load
+const sealedKeyPrefix = "sealed:"
+
+var (
+	caCertificate *x509.Certificate
+	caKey         *ecdsa.PrivateKey
+	caCertPEM     []byte
+	// client certificate of the orchestrator for health checks against backends that require one
+	orchestratorCertificate *tls.Certificate
+)
+
+func loadCertificateAuthority() error {
+	if dir := os.Getenv("CERTS_DIR"); dir != "" {
+		containerCertsDir = dir
+	}
+	secret, err := caKeySecret()
+	if err != nil {
+		return err
+	}
+	var ca CertificateAuthority
+	err = db.Limit(1).Find(&ca).Error
+	if err != nil {
+		return err
+	}
+	if ca.ID == 0 {
+		ca, err = newCertificateAuthority()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Created internal certificate authority")
+	}
+	keyPEM, err := openCAKey(ca.KeyPEM, secret)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(ca.KeyPEM, sealedKeyPrefix) {
+		ca.KeyPEM, err = sealCAKey(keyPEM, secret)
+		if err != nil {
+			return err
+		}
+		err = db.Save(&ca).Error
+		if err != nil {
+			return err
+		}
+	}
+	pair, err := tls.X509KeyPair([]byte(ca.CertPEM), keyPEM)
+	if err != nil {
+		return err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("certificate authority key is not an ECDSA key")
+	}
+	caCertificate, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	caKey = key
+	caCertPEM = []byte(ca.CertPEM)
+	certPEM, keyPEM, err := issueCertificate("orchestrator")
+	if err != nil {
+		return err
+	}
+	orchestratorPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	orchestratorCertificate = &orchestratorPair
+	return nil
+}
+
+// caKeySecret returns the secret the CA key is encrypted with, from CA_KEY_SECRET or the file at CA_KEY_SECRET_FILE.
+// Without either it is generated into a file in the config directory of the orchestrator user, readable by that user only.
+// Orchestrator nodes on other hosts have to be given the same secret.
+func caKeySecret() ([]byte, error) {
+	if secret := os.Getenv("CA_KEY_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	path := os.Getenv("CA_KEY_SECRET_FILE")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "load-balancer", "ca-key.secret")
+	}
+	secret, err := os.ReadFile(path)
+	if err == nil {
+		return bytes.TrimSpace(secret), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	secret = []byte(hex.EncodeToString(random))
+	// the nodes started together race to create it, the first one wins
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return caKeySecret()
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(secret)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Created the secret of the certificate authority key in", path)
+	return secret, nil
+}
+
+func caKeyCipher(secret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealCAKey(keyPEM []byte, secret []byte) (string, error) {
+	aead, err := caKeyCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return sealedKeyPrefix + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, keyPEM, nil)), nil
+}
+
+func openCAKey(stored string, secret []byte) ([]byte, error) {
+	if !strings.HasPrefix(stored, sealedKeyPrefix) {
+		return []byte(stored), nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := caKeyCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("certificate authority key is too short")
+	}
+	keyPEM, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("certificate authority key can not be decrypted, the orchestrator has another secret than the one it was stored with")
+	}
+	return keyPEM, nil
+}
+
+func newCertificateAuthority() (CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return CertificateAuthority{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerialNumber(),
+		Subject:               pkix.Name{CommonName: "load-balancer internal CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return CertificateAuthority{}, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return CertificateAuthority{}, err
+	}
+	return CertificateAuthority{
+		CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:  string(keyPEM),
+	}, nil
+}
+
+// issueCertificate signs a certificate for the name that works for both ends of a connection
+func issueCertificate(name string) ([]byte, []byte, error) {
+	if caCertificate == nil {
+		return nil, nil, errors.New("no certificate authority loaded")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCertificate, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func randomSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func containerCertsUID() int {
+	uid, err := strconv.Atoi(os.Getenv("CONTAINER_CERTS_UID"))
+	if err != nil {
+		return defaultContainerCertsUID
+	}
+	return uid
+}
+
+// certsVolumeFlag issues a certificate for the container and returns the docker flag mounting it at /certs.
+// A container that needs one can not serve without it, so it is not started when the certificate can not be written.
+// The directory and the key belong to the user of the container and nobody else on the host can read the key,
+// which takes an orchestrator running as root or as that user.
+func certsVolumeFlag(containerName string) (string, error) {
+	certPEM, keyPEM, err := issueCertificate(containerName)
+	if err != nil {
+		return "", fmt.Errorf("error issuing certificate for %s: %w", containerName, err)
+	}
+	uid := containerCertsUID()
+	dir := filepath.Join(containerCertsDir, containerName)
+	err = os.MkdirAll(dir, 0700)
+	if err == nil {
+		// directories from before keep their mode otherwise
+		err = os.Chmod(containerCertsDir, 0700)
+	}
+	if err == nil {
+		err = os.Chmod(dir, 0700)
+	}
+	if err == nil {
+		err = os.Chown(dir, uid, uid)
+	}
+	if err == nil {
+		err = writeContainerFile(filepath.Join(dir, "cert.pem"), certPEM, 0644, uid)
+	}
+	if err == nil {
+		err = writeContainerFile(filepath.Join(dir, "key.pem"), keyPEM, 0600, uid)
+	}
+	if err == nil {
+		err = writeContainerFile(filepath.Join(dir, "ca.pem"), caCertPEM, 0644, uid)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error writing certificate for %s: %w", containerName, err)
+	}
+	return " -v " + shellQuote(dir+":/certs:ro"), nil
+}
+
+// writeContainerFile replaces the file, so a file left by an earlier container does not keep its mode and owner
+func writeContainerFile(path string, data []byte, mode os.FileMode, uid int) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	err = f.Chown(uid, uid)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func removeContainerCertificates(containerName string) {
+	err := os.RemoveAll(filepath.Join(containerCertsDir, containerName))
+	if err != nil {
+		fmt.Println("Error removing certificate of", containerName, ":", err)
+	}
+}
+
+// backendTLSConfig verifies a backend by its container name while connecting to it through its published port
+func backendTLSConfig(backend *BackendServer) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCertPEM)
+	config := &tls.Config{
+		RootCAs:    roots,
+		ServerName: backend.ContainerName,
+	}
+	if orchestratorCertificate != nil {
+		config.Certificates = []tls.Certificate{*orchestratorCertificate}
+	}
+	return config
+}
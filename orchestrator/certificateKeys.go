@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// load balancers fetch the private keys of the certificates they serve here, over mutual TLS with the
+// certificate mounted into their container. The service stream only carries the certificates, it is not authenticated.
+const certificateKeysAddr = ":3443"
+
+// CertificateKey is the private key of a stored certificate
+type CertificateKey struct {
+	ID     uint   `json:"id"`
+	KeyPEM string `json:"keyPem"`
+}
+
+func serveCertificateKeys() {
+	if orchestratorCertificate == nil {
+		fmt.Println("No certificate authority, load balancers can not fetch the keys of their certificates")
+		return
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCertPEM)
+	router := gin.Default()
+	router.GET("/api/load-balancers/certificate-keys", func(context *gin.Context) {
+		getCertificateKeys(context)
+	})
+	server := &http.Server{
+		Addr:    certificateKeysAddr,
+		Handler: router,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*orchestratorCertificate},
+			ClientCAs:    roots,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	err := server.ListenAndServeTLS("", "")
+	if err != nil {
+		fmt.Println("Error serving certificate keys:", err)
+	}
+}
+
+// getCertificateKeys returns the keys of a service to one of its load balancers, or to any load balancer
+// when routes send requests to the service. Backends have certificates from the same CA, so the
+// container named by the client certificate has to be a load balancer.
+func getCertificateKeys(c *gin.Context) {
+	loadBalancer := c.Request.TLS.PeerCertificates[0].Subject.CommonName
+	var lb LoadBalancerServer
+	db.Where("container_name = ?", loadBalancer).Limit(1).Find(&lb)
+	if lb.ID == 0 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Not a load balancer",
+		})
+		return
+	}
+	var service Service
+	db.Where("name = ?", c.Query("service")).Limit(1).Find(&service)
+	if service.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Service not found",
+		})
+		return
+	}
+	if lb.ServiceID != service.ID && !isRouted(service.Name) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Service is not served by the load balancer",
+		})
+		return
+	}
+	var certificates []Certificate
+	err := db.Where("service_id = ?", service.ID).Find(&certificates).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	keys := make([]CertificateKey, 0, len(certificates))
+	for _, certificate := range certificates {
+		keys = append(keys, CertificateKey{ID: certificate.ID, KeyPEM: certificate.KeyPEM})
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// withoutKeys copies the certificates without their private keys
+func withoutKeys(certificates []*Certificate) []*Certificate {
+	stripped := make([]*Certificate, 0, len(certificates))
+	for _, certificate := range certificates {
+		copied := *certificate
+		copied.KeyPEM = ""
+		stripped = append(stripped, &copied)
+	}
+	return stripped
+}
@@ -15,7 +15,7 @@ func getDb() *gorm.DB {
 
 	fmt.Println("Connected to database")
 	//Migrate the schema
-	err = db.AutoMigrate(&Service{}, &BackendServer{}, &LoadBalancerServer{})
+	err = db.AutoMigrate(&Service{}, &BackendServer{}, &LoadBalancerServer{}, &Certificate{}, &CertificateAuthority{}, &Route{})
 	if err != nil {
 		fmt.Println("Error migrating schema", err)
 	}
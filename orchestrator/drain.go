@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultDrainTimeout = 30
+
+const drainPollInterval = 500 * time.Millisecond
+
+// backends taken out of rotation whose containers still run, by service name
+var (
+	drainsLock       sync.Mutex
+	drainingBackends = make(map[string][]*BackendServer)
+)
+
+func getDrainingBackends(serviceName string) []*BackendServer {
+	drainsLock.Lock()
+	defer drainsLock.Unlock()
+	return slices.Clone(drainingBackends[serviceName])
+}
+
+func findService(name string) *Service {
+	for _, service := range services {
+		if service.Name == name {
+			return service
+		}
+	}
+	return nil
+}
+
+// drainBackendServer takes a backend that was removed from service.Backends out of rotation.
+// Its container is stopped once no load balancer has requests in flight to it or the drain timeout of the service passed.
+func drainBackendServer(ctx context.Context, service *Service, backend *BackendServer) {
+	fmt.Printf("Draining backend server on Port %d\n", backend.Port)
+	backend.IsDraining = true
+	db.Model(backend).Update("is_draining", true)
+	drainsLock.Lock()
+	drainingBackends[service.Name] = append(drainingBackends[service.Name], backend)
+	drainsLock.Unlock()
+	version := publishServiceUpdate(service)
+	drainTimeout := service.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	go finishDrain(ctx, service.Name, backend, version, time.Duration(drainTimeout)*time.Second)
+}
+
+func finishDrain(ctx context.Context, serviceName string, backend *BackendServer, version uint64, drainTimeout time.Duration) {
+	deadline := time.Now().Add(drainTimeout)
+	for !backendDrained(serviceName, backend, version) {
+		if time.Now().After(deadline) {
+			fmt.Printf("Drain timeout of backend server on Port %d passed, stopping it with requests in flight\n", backend.Port)
+			break
+		}
+		time.Sleep(drainPollInterval)
+	}
+	stopBackendServer(ctx, backend)
+	drainsLock.Lock()
+	drainingBackends[serviceName] = slices.DeleteFunc(drainingBackends[serviceName], func(b *BackendServer) bool {
+		return b == backend
+	})
+	if len(drainingBackends[serviceName]) == 0 {
+		delete(drainingBackends, serviceName)
+	}
+	drainsLock.Unlock()
+	// the service may have been reloaded while draining
+	if service := findService(serviceName); service != nil {
+		publishServiceUpdate(service)
+	}
+}
+
+// backendDrained tells if every healthy load balancer applied the version that marks the backend as draining
+// and has no more requests in flight to it
+func backendDrained(serviceName string, backend *BackendServer, version uint64) bool {
+	service := findService(serviceName)
+	if service == nil {
+		return true
+	}
+	publisher := getPublisher(serviceName)
+	loadBalancers := service.LoadBalancers
+	if isRouted(serviceName) {
+		// every load balancer follows the routes, so any of them may have requests in flight to the backend
+		loadBalancers = nil
+		for _, s := range services {
+			loadBalancers = append(loadBalancers, s.LoadBalancers...)
+		}
+	}
+	for _, lb := range loadBalancers {
+		if !lb.IsHealthy {
+			continue
+		}
+		if !publisher.acked(lb.ContainerName, version) {
+			return false
+		}
+		inFlight, ok := loadBalancerInFlightCall(lb.HealthPort)
+		if !ok || inFlight[backend.ContainerName] > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// grpc.health.v1.HealthCheckResponse.ServingStatus
+const grpcHealthServing = 1
+
+const maxGRPCHealthResponseBytes = 4 << 10
+
+// backendServerGRPCHealthCall runs the standard grpc.health.v1 check against a backend in gRPC mode.
+// GRPCHealthService names the service to check, the server as a whole is checked without one.
+func backendServerGRPCHealthCall(ctx context.Context, backend *BackendServer, service *Service) bool {
+	transport := &http2.Transport{}
+	scheme := "http"
+	if service.UpstreamTLS {
+		scheme = "https"
+		transport.TLSClientConfig = backendTLSConfig(backend)
+	} else {
+		// h2c with prior knowledge
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	defer transport.CloseIdleConnections()
+	httpClient := http.Client{
+		Timeout:   3 * time.Second,
+		Transport: transport,
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprint(scheme, "://localhost:", backend.Port, "/grpc.health.v1.Health/Check"),
+		bytes.NewReader(grpcHealthCheckRequest(service.GRPCHealthService)))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxGRPCHealthResponseBytes))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	// the status is in the trailers, or in the headers when the backend answered without a message
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+	if grpcStatus != "0" {
+		fmt.Println("gRPC health check of", backend.ContainerName, "failed with status", grpcStatus, resp.Header.Get("Grpc-Message"), resp.Trailer.Get("Grpc-Message"))
+		return false
+	}
+	status, err := parseGRPCHealthCheckResponse(body)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	return status == grpcHealthServing
+}
+
+// grpcHealthCheckRequest encodes a grpc.health.v1.HealthCheckRequest as a length-prefixed gRPC message
+func grpcHealthCheckRequest(serviceName string) []byte {
+	message := make([]byte, 0, len(serviceName)+binary.MaxVarintLen64+1)
+	if serviceName != "" {
+		// field 1, length delimited
+		message = append(message, 0x0a)
+		message = binary.AppendUvarint(message, uint64(len(serviceName)))
+		message = append(message, serviceName...)
+	}
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// parseGRPCHealthCheckResponse reads the status field out of a grpc.health.v1.HealthCheckResponse
+func parseGRPCHealthCheckResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, errors.New("gRPC health check response too short")
+	}
+	if body[0] != 0 {
+		return 0, errors.New("compressed gRPC health check response")
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	if uint64(len(body)-5) < uint64(length) {
+		return 0, errors.New("truncated gRPC health check response")
+	}
+	message := body[5 : 5+length]
+	status := uint64(0)
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("invalid gRPC health check response")
+		}
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, errors.New("invalid gRPC health check response")
+			}
+			message = message[n:]
+			if key>>3 == 1 {
+				status = value
+			}
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return 0, errors.New("invalid gRPC health check response")
+			}
+			message = message[n+int(length):]
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d in gRPC health check response", key&7)
+		}
+	}
+	return status, nil
+}
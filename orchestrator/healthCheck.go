@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"math"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -23,10 +30,10 @@ func serviceHealthChecks(service *Service) {
 	healthCounter := 0
 	maxLbCount := int(math.Ceil(float64(service.Max)/2)) + 1
 	if len(service.LoadBalancers) == 0 {
-		startLoadBalancerServers(service)
+		startLoadBalancerServers(context.Background(), service)
 	}
 	if len(service.Backends) == 0 {
-		startBackendServers(service)
+		startBackendServers(context.Background(), service)
 	}
 	for {
 		select {
@@ -39,13 +46,17 @@ func serviceHealthChecks(service *Service) {
 		case <-tickerLB.C:
 			{
 				//fmt.Println("LB Health Check ", service.Name, "Current LBs:", len(service.LoadBalancers))
+				ctx, span := tracer.Start(context.Background(), "load balancer health check round", trace.WithAttributes(
+					attribute.String("lb.service", service.Name),
+				))
 				wg := sync.WaitGroup{}
 				wg.Add(len(service.LoadBalancers))
 				reqRateChannel := make(chan float64)
+				circuits := &circuitReport{open: make(map[string]int)}
 
 				totalLbReqRate := 0.0
 				for index, _ := range service.LoadBalancers {
-					go loadBalancerServerHealthCheck(index, service, reqRateChannel, &wg)
+					go loadBalancerServerHealthCheck(ctx, index, service, reqRateChannel, circuits, &wg)
 				}
 				healthyLbCount := 0
 				for _, lb := range service.LoadBalancers {
@@ -61,6 +72,7 @@ func serviceHealthChecks(service *Service) {
 					if b.IsHealthy {
 						healthyBackendCount++
 					}
+					b.openCircuits = circuits.open[b.ContainerName]
 				}
 				//update the last ten request rates
 				lastFiveTotalRequestRate = append(lastFiveTotalRequestRate[1:], totalLbReqRate)
@@ -75,7 +87,7 @@ func serviceHealthChecks(service *Service) {
 							if healthyBackendCount < service.Max {
 								backend := getNewBackendServer(service)
 								service.Backends = append(service.Backends, backend)
-								_, err := runBackendServer(backend, service)
+								_, err := runBackendServer(ctx, backend, service)
 								if err != nil {
 									fmt.Println(err)
 								}
@@ -86,8 +98,7 @@ func serviceHealthChecks(service *Service) {
 							if healthyBackendCount > service.Min {
 								backend := service.Backends[len(service.Backends)-1]
 								service.Backends = service.Backends[:len(service.Backends)-1]
-								stopBackendServer(backend)
-								go callLoadBalancerServiceUpdateEndpoints(service)
+								drainBackendServer(ctx, service, backend)
 							}
 						}
 					}
@@ -95,7 +106,7 @@ func serviceHealthChecks(service *Service) {
 						if healthyLbCount < maxLbCount {
 							lb := getNewLoadBalancer(service)
 							service.LoadBalancers = append(service.LoadBalancers, lb)
-							_, err := runLoadBalancerServer(lb, service)
+							_, err := runLoadBalancerServer(ctx, lb, service)
 							if err != nil {
 								fmt.Println(err)
 							}
@@ -105,7 +116,7 @@ func serviceHealthChecks(service *Service) {
 							if healthyLbCount > MinLBCount {
 								lb := service.LoadBalancers[len(service.LoadBalancers)-1]
 								service.LoadBalancers = service.LoadBalancers[:len(service.LoadBalancers)-1]
-								stopLoadBalancerServer(lb)
+								stopLoadBalancerServer(ctx, lb)
 							}
 						}
 					}
@@ -113,52 +124,65 @@ func serviceHealthChecks(service *Service) {
 
 				if len(service.LoadBalancers) < MinLBCount {
 					for i := 0; i < (MinLBCount - len(service.LoadBalancers)); i++ {
-						startLoadBalancerServer(service)
+						startLoadBalancerServer(ctx, service)
 					}
 				}
+				span.End()
 			}
 
 		case <-tickerBackend.C:
 			{
 				//fmt.Println("Backend Health Check ", service.Name, "Min:", service.Min, "Max:", service.Max, "Current Backends:", len(service.Backends))
+				ctx, span := tracer.Start(context.Background(), "backend health check round", trace.WithAttributes(
+					attribute.String("lb.service", service.Name),
+				))
 				lenBackends := len(service.Backends)
 				wg := sync.WaitGroup{}
 				wg.Add(lenBackends)
 				for index, _ := range service.Backends {
-					go backendServerHealthCheck(index, service, &wg)
+					go backendServerHealthCheck(ctx, index, service, &wg)
 				}
 				wg.Wait()
 				if lenBackends < service.Min {
 					for i := 0; i < service.Min-lenBackends; i++ {
-						startBackendServer(service)
+						startBackendServer(ctx, service)
 					}
 				}
+				span.End()
 			}
 		}
 	}
 
 }
 
-func backendServerHealthCheck(bIndex int, service *Service, wg *sync.WaitGroup) {
+func backendServerHealthCheck(ctx context.Context, bIndex int, service *Service, wg *sync.WaitGroup) {
 	defer wg.Done()
+	ctx, span := tracer.Start(ctx, "backend health check", trace.WithAttributes(
+		attribute.String("container.name", service.Backends[bIndex].ContainerName),
+	))
+	defer span.End()
 	if service.Backends[bIndex].unHealthyCount >= service.UnHealthyThreshold {
 		fmt.Printf("\n\nBackend server on Port %d is unhealthy\n", service.Backends[bIndex].Port)
-		//stop the container
-		stopBackendServer(service.Backends[bIndex])
-		service.Backends[bIndex] = getNewBackendServer(service)
-		_, err := runBackendServer(service.Backends[bIndex], service)
-		go callLoadBalancerServiceUpdateEndpoints(service)
+		//replace the container, the old one is stopped once its requests are done
+		unhealthyBackend := service.Backends[bIndex]
+		service.Backends[bIndex] = getReplacementBackendServer(service, unhealthyBackend)
+		_, err := runBackendServer(ctx, service.Backends[bIndex], service)
+		drainBackendServer(ctx, service, unhealthyBackend)
 		if err != nil {
 			fmt.Println(err)
 		}
 		service.Backends[bIndex].unHealthyCount = 0
 		return
 	}
-	success := backendServerHealthEndpointCall(service.Backends[bIndex], service)
+	success := backendServerHealthEndpointCall(ctx, service.Backends[bIndex], service)
+	if success && circuitOpenOnMostLoadBalancers(service, service.Backends[bIndex]) {
+		fmt.Printf("Circuit of backend server on Port %d is open on most load balancers\n", service.Backends[bIndex].Port)
+		success = false
+	}
 	if success {
 		if service.Backends[bIndex].IsHealthy == false {
 			db.Model(service.Backends[bIndex]).Update("is_healthy", true)
-			go callLoadBalancerServiceUpdateEndpoints(service)
+			publishServiceUpdate(service)
 		}
 		if service.Backends[bIndex].unHealthyCount > 0 {
 			service.Backends[bIndex].unHealthyCount--
@@ -166,18 +190,18 @@ func backendServerHealthCheck(bIndex int, service *Service, wg *sync.WaitGroup)
 	} else {
 		db.Model(service.Backends[bIndex]).Update("is_healthy", false)
 		service.Backends[bIndex].unHealthyCount++
-		go callLoadBalancerServiceUpdateEndpoints(service)
+		publishServiceUpdate(service)
 	}
 }
 
-func loadBalancerServerHealthCheck(lbIndex int, service *Service, c chan float64, wg *sync.WaitGroup) {
+func loadBalancerServerHealthCheck(ctx context.Context, lbIndex int, service *Service, c chan float64, circuits *circuitReport, wg *sync.WaitGroup) {
 	defer wg.Done()
 	if service.LoadBalancers[lbIndex].unHealthyCount >= 2 {
 		fmt.Printf("\n\nLoad Balancer server on Port %d is unhealthy\n", service.LoadBalancers[lbIndex].Port)
 		//stop the container
-		stopLoadBalancerServer(service.LoadBalancers[lbIndex])
+		stopLoadBalancerServer(ctx, service.LoadBalancers[lbIndex])
 		service.LoadBalancers[lbIndex] = getNewLoadBalancer(service)
-		_, err := runLoadBalancerServer(service.LoadBalancers[lbIndex], service)
+		_, err := runLoadBalancerServer(ctx, service.LoadBalancers[lbIndex], service)
 		if err != nil {
 			fmt.Println(err)
 		}
@@ -185,7 +209,7 @@ func loadBalancerServerHealthCheck(lbIndex int, service *Service, c chan float64
 		c <- 0.0
 		return
 	}
-	lbReqRate, success := loadBalancerServerHealthEndpointCall(service.LoadBalancers[lbIndex].HealthPort)
+	lbReqRate, success := loadBalancerServerHealthEndpointCall(ctx, service.LoadBalancers[lbIndex].HealthPort)
 	if success {
 		if service.LoadBalancers[lbIndex].IsHealthy == false {
 			db.Model(service.LoadBalancers[lbIndex]).Update("is_healthy", true)
@@ -193,6 +217,7 @@ func loadBalancerServerHealthCheck(lbIndex int, service *Service, c chan float64
 		if service.LoadBalancers[lbIndex].unHealthyCount > 0 {
 			service.LoadBalancers[lbIndex].unHealthyCount = 0
 		}
+		circuits.add(loadBalancerCircuitBreakersCall(service.LoadBalancers[lbIndex].HealthPort))
 		c <- lbReqRate
 		return
 
@@ -204,11 +229,16 @@ func loadBalancerServerHealthCheck(lbIndex int, service *Service, c chan float64
 	return
 }
 
-func loadBalancerServerHealthEndpointCall(port int) (float64, bool) {
+func loadBalancerServerHealthEndpointCall(ctx context.Context, port int) (float64, bool) {
 	httpClient := http.Client{
 		Timeout: 5 * time.Second,
 	}
-	resp, err := httpClient.Get(fmt.Sprint("http://localhost:", port, "/lb-health"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprint("http://localhost:", port, "/lb-health"), nil)
+	if err != nil {
+		return 0.0, false
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		fmt.Println("Error:", err)
 		return 0.0, false
@@ -232,40 +262,152 @@ func loadBalancerServerHealthEndpointCall(port int) (float64, bool) {
 	return reqRate, true
 }
 
-func backendServerHealthEndpointCall(backend *BackendServer, service *Service) bool {
+// circuitReport counts for every backend the load balancers that have its circuit open
+type circuitReport struct {
+	lock sync.Mutex
+	open map[string]int
+}
+
+type circuitBreakerStatus struct {
+	ContainerName string `json:"containerName"`
+	State         string `json:"state"`
+}
+
+func (r *circuitReport) add(statuses []circuitBreakerStatus) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, status := range statuses {
+		if status.State == "open" {
+			r.open[status.ContainerName]++
+		}
+	}
+}
+
+// loadBalancerInFlightCall returns the requests the load balancer has in flight to each backend
+func loadBalancerInFlightCall(port int) (map[string]int64, bool) {
 	httpClient := http.Client{
-		Timeout: 3 * time.Second,
+		Timeout: 2 * time.Second,
 	}
-	resp, err := httpClient.Get(fmt.Sprint("http://localhost:", backend.Port, service.HealthEndpoint))
+	resp, err := httpClient.Get(fmt.Sprint("http://localhost:", port, "/in-flight"))
 	if err != nil {
 		fmt.Println("Error:", err)
-		return false
+		return nil, false
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return false
+		return nil, false
 	}
-	return true
+	var inFlight map[string]int64
+	err = json.NewDecoder(resp.Body).Decode(&inFlight)
+	if err != nil {
+		return nil, false
+	}
+	return inFlight, true
+}
+
+func loadBalancerCircuitBreakersCall(port int) []circuitBreakerStatus {
+	httpClient := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := httpClient.Get(fmt.Sprint("http://localhost:", port, "/circuit-breakers"))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil
+	}
+	var statuses []circuitBreakerStatus
+	err = json.NewDecoder(resp.Body).Decode(&statuses)
+	if err != nil {
+		return nil
+	}
+	return statuses
 }
 
-func callLoadBalancerServiceUpdateEndpoints(service *Service) {
+// circuitOpenOnMostLoadBalancers tells if the backend fails real traffic even though its health endpoint answers
+func circuitOpenOnMostLoadBalancers(service *Service, backend *BackendServer) bool {
+	healthyLbCount := 0
 	for _, lb := range service.LoadBalancers {
 		if lb.IsHealthy {
-			go loadBalancerServiceUpdateEndpointCall(lb.HealthPort)
+			healthyLbCount++
 		}
 	}
+	return healthyLbCount > 0 && backend.openCircuits*2 > healthyLbCount
 }
-func loadBalancerServiceUpdateEndpointCall(port int) {
+
+func backendServerHealthEndpointCall(ctx context.Context, backend *BackendServer, service *Service) bool {
+	if service.Protocol == "grpc" {
+		return backendServerGRPCHealthCall(ctx, backend, service)
+	}
+	if service.Protocol == "tcp" {
+		return backendServerTCPHealthCall(ctx, backend)
+	}
+	// udp mode backends without a probe serve the health endpoint over HTTP on the same port
+	if service.Protocol == "udp" && service.UDPHealthProbe != "" {
+		return backendServerUDPHealthCall(ctx, backend, service)
+	}
 	httpClient := http.Client{
-		Timeout: 5 * time.Second,
+		Timeout: 3 * time.Second,
+	}
+	scheme := "http"
+	if service.UpstreamTLS {
+		scheme = "https"
+		httpClient.Transport = &http.Transport{TLSClientConfig: backendTLSConfig(backend), DisableKeepAlives: true}
 	}
-	resp, err := httpClient.Get(fmt.Sprint("http://localhost:", port, "/service-update"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprint(scheme, "://localhost:", backend.Port, service.HealthEndpoint), nil)
+	if err != nil {
+		return false
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		fmt.Println("Error:", err)
-		return
+		return false
 	}
-
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		fmt.Println("SERVICE UPDATE STATUS CODE NOT 200", "PORT:", port, "STATUS CODE:", resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// backendServerTCPHealthCall only checks that the backend accepts connections, tcp mode backends
+// such as databases speak no protocol the orchestrator knows
+func backendServerTCPHealthCall(ctx context.Context, backend *BackendServer) bool {
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprint("localhost:", backend.Port))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
 	}
+	conn.Close()
+	return true
+}
+
+// backendServerUDPHealthCall sends the probe of the service, any answer within the timeout counts as healthy
+func backendServerUDPHealthCall(ctx context.Context, backend *BackendServer, service *Service) bool {
+	probe, err := hex.DecodeString(service.UDPHealthProbe)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	conn, err := dialer.DialContext(ctx, "udp", fmt.Sprint("localhost:", backend.Port))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Write(probe)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 65535))
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	return true
 }
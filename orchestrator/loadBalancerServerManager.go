@@ -1,14 +1,31 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var LoadBalancerContainerImageName = "load-balancer-server:latest"
 
-func runLoadBalancerServer(lb *LoadBalancerServer, service *Service) (bool, error) {
-	_, err := runCommand("start load balancer server", fmt.Sprintf("docker run -e CONTAINER_NAME=%s -e SERVICE_NAME=%s -d -p %d:4000 -p %d:3210  --network load-balancer-network --name %s %s", lb.ContainerName, service.Name, lb.Port, lb.HealthPort, lb.ContainerName, LoadBalancerContainerImageName))
+// seconds docker waits before killing a load balancer, enough for it to fail its health check and finish its requests
+const loadBalancerStopTimeout = 35
+
+func runLoadBalancerServer(ctx context.Context, lb *LoadBalancerServer, service *Service) (bool, error) {
+	_, span := tracer.Start(ctx, "runLoadBalancerServer", trace.WithAttributes(
+		attribute.String("lb.service", service.Name),
+		attribute.String("container.name", lb.ContainerName),
+	))
+	// the certificate authenticates the load balancer to the backends and to the orchestrator for the keys it serves
+	certsFlag, err := certsVolumeFlag(lb.ContainerName)
+	if err != nil {
+		endSpan(span, err)
+		return false, err
+	}
+	_, err = runCommand("start load balancer server", fmt.Sprintf("docker run -e CONTAINER_NAME=%s -e SERVICE_NAME=%s -e TLS_PORT=%d%s%s -d -p %d:4000 -p %d:3210 -p %d:4443 -p %d:5000 -p %d:6000/udp  --network load-balancer-network --name %s %s", lb.ContainerName, service.Name, lb.TLSPort, traceEnvFlags(), certsFlag, lb.Port, lb.HealthPort, lb.TLSPort, lb.TCPPort, lb.UDPPort, lb.ContainerName, LoadBalancerContainerImageName))
+	endSpan(span, err)
 	if err != nil {
 		return false, errors.New("error running docker container")
 	} else {
@@ -17,8 +34,12 @@ func runLoadBalancerServer(lb *LoadBalancerServer, service *Service) (bool, erro
 	return true, nil
 }
 
-func stopLoadBalancerServer(lb *LoadBalancerServer) {
-	_, errStop := runCommand("stop load balancer server", fmt.Sprintf("docker stop %s", lb.ContainerName))
+func stopLoadBalancerServer(ctx context.Context, lb *LoadBalancerServer) {
+	_, span := tracer.Start(ctx, "stopLoadBalancerServer", trace.WithAttributes(
+		attribute.String("container.name", lb.ContainerName),
+	))
+	defer span.End()
+	_, errStop := runCommand("stop load balancer server", fmt.Sprintf("docker stop -t %d %s", loadBalancerStopTimeout, lb.ContainerName))
 	if errStop != nil {
 		fmt.Println(errStop)
 	}
@@ -27,6 +48,7 @@ func stopLoadBalancerServer(lb *LoadBalancerServer) {
 	if errDel != nil {
 		fmt.Println(errDel)
 	}
+	removeContainerCertificates(lb.ContainerName)
 	db.Delete(&LoadBalancerServer{}, "id = ?", lb.ID)
 }
 
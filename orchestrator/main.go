@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -14,6 +16,9 @@ type BackendServer struct {
 	Port           int  `json:"port"`
 	unHealthyCount int
 	ContainerName  string `json:"containerName"`
+	Weight         int    `json:"weight" gorm:"default:1"`
+	IsDraining     bool   `json:"isDraining"`
+	openCircuits   int
 }
 
 type LoadBalancerServer struct {
@@ -22,10 +27,22 @@ type LoadBalancerServer struct {
 	IsHealthy      bool `json:"-"`
 	Port           int  `json:"port"`
 	HealthPort     int  `json:"-"`
+	TLSPort        int  `json:"tlsPort"`
+	TCPPort        int  `json:"tcpPort"`
+	UDPPort        int  `json:"udpPort"`
 	unHealthyCount int
 	ContainerName  string `json:"-"`
 }
 
+// Certificate is served by the load balancers of its service to clients asking for one of its hostnames
+type Certificate struct {
+	ID        uint   `json:"id"`
+	ServiceID uint   `json:"serviceId"`
+	Hostnames string `json:"hostnames"`
+	CertPEM   string `json:"certPem"`
+	KeyPEM    string `json:"keyPem"`
+}
+
 type Service struct {
 	ID                  uint                  `json:"id"`
 	Name                string                `json:"name" gorm:"unique"`
@@ -38,12 +55,72 @@ type Service struct {
 	ContainerImageName  string                `json:"containerImageName"`
 	ContainerPort       int                   `json:"containerPort"`
 	LoadBalancers       []*LoadBalancerServer `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
-	endServiceChecks    chan bool
+	Certificates        []*Certificate        `json:"certificates" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	TLSRedirect         bool                  `json:"tlsRedirect"`
+	Strategy            string                `json:"strategy"`
+	HashKeySource       string                `json:"hashKeySource"`
+	HashKeyName         string                `json:"hashKeyName"`
+	UpstreamTimeout     int                   `json:"upstreamTimeout"`
+	UpstreamTLS         bool                  `json:"upstreamTls"`
+	UpstreamHTTP2       bool                  `json:"upstreamHttp2"`
+	Protocol            string                `json:"protocol"`
+	GRPCHealthService   string                `json:"grpcHealthService"`
+	TCPIdleTimeout      int                   `json:"tcpIdleTimeout"`
+	UDPIdleTimeout      int                   `json:"udpIdleTimeout"`
+	UDPHealthProbe      string                `json:"udpHealthProbe"` // hex encoded datagram udp mode backends have to answer
+	DrainTimeout        int                   `json:"drainTimeout"`
+
+	OutlierConsecutiveFailures int `json:"outlierConsecutiveFailures"`
+	OutlierErrorRatePercent    int `json:"outlierErrorRatePercent"`
+	OutlierBaseEjectionSeconds int `json:"outlierBaseEjectionSeconds"`
+	OutlierMaxEjectionPercent  int `json:"outlierMaxEjectionPercent"`
+
+	RetryMaxAttempts   int    `json:"retryMaxAttempts"`
+	RetryOnStatus      string `json:"retryOnStatus"`
+	RetryNonIdempotent bool   `json:"retryNonIdempotent"`
+	RetryBudgetPercent int    `json:"retryBudgetPercent"`
+	RetryOnGRPCStatus  string `json:"retryOnGrpcStatus"`
+
+	CircuitConsecutiveFailures int `json:"circuitConsecutiveFailures"`
+	CircuitErrorRatePercent    int `json:"circuitErrorRatePercent"`
+	CircuitMinRequests         int `json:"circuitMinRequests"`
+	CircuitOpenSeconds         int `json:"circuitOpenSeconds"`
+	CircuitHalfOpenRequests    int `json:"circuitHalfOpenRequests"`
+
+	AccessLogFormat     string  `json:"accessLogFormat"`
+	AccessLogFields     string  `json:"accessLogFields"`
+	AccessLogSampleRate float64 `json:"accessLogSampleRate"`
+	AccessLogLevel      string  `json:"accessLogLevel"`
+
+	Rewrite *RewriteRules `json:"rewrite" gorm:"serializer:json"`
+
+	RateLimitPerSecond float64 `json:"rateLimitPerSecond"`
+	RateLimitBurst     int     `json:"rateLimitBurst"`
+	RateLimitKey       string  `json:"rateLimitKey"`
+	RateLimitHeader    string  `json:"rateLimitHeader"`
+	RateLimitGlobal    bool    `json:"rateLimitGlobal"`
+
+	MaxInFlight               int    `json:"maxInFlight"`
+	AdaptiveConcurrency       bool   `json:"adaptiveConcurrency"`
+	ConcurrencyQueueSize      int    `json:"concurrencyQueueSize"`
+	ConcurrencyQueueTimeoutMs int    `json:"concurrencyQueueTimeoutMs"`
+	PriorityHeader            string `json:"priorityHeader"`
+
+	CacheEnabled     bool   `json:"cacheEnabled"`
+	CacheMemoryMB    int    `json:"cacheMemoryMb"`
+	CacheMaxObjectKB int    `json:"cacheMaxObjectKb"`
+	CacheDiskDir     string `json:"cacheDiskDir"`
+	CacheDiskMB      int    `json:"cacheDiskMb"`
+
+	endServiceChecks chan bool
 }
 
 var (
 	lbHealthPortCounter = 3201
 	lbPortCounter       = 5001
+	lbTLSPortCounter    = 6001
+	lbTCPPortCounter    = 8001
+	lbUDPPortCounter    = 9001
 	backendPortCounter  = 7001
 
 	isStart = true
@@ -54,6 +131,9 @@ var (
 func increaseLoadBalancerPortCounter() {
 	lbPortCounter++
 	lbHealthPortCounter++
+	lbTLSPortCounter++
+	lbTCPPortCounter++
+	lbUDPPortCounter++
 }
 
 func increaseBackendPortCounter() {
@@ -65,6 +145,7 @@ var services []*Service
 var db = getDb()
 
 func main() {
+	defer initTracing()()
 	fmt.Println("Welcome to the load balancer!")
 	//go quit()
 	leaderElection()
@@ -72,7 +153,7 @@ func main() {
 
 func orchestrate() {
 	go apis()
-	db.Preload("Backends").Preload("LoadBalancers").Find(&services)
+	db.Preload("Backends").Preload("LoadBalancers").Preload("Certificates").Find(&services)
 	if isStart {
 		//stop all backend and load balancer servers
 		_, errStop := runCommand("stop all containers", "docker stop $(docker ps --format '{{.Names}}' | grep '^lb-')")
@@ -86,8 +167,13 @@ func orchestrate() {
 		}
 		db.Delete(&LoadBalancerServer{}, "id > 0")
 		db.Delete(&BackendServer{}, "id > 0")
-		db.Preload("Backends").Preload("LoadBalancers").Find(&services)
+		db.Preload("Backends").Preload("LoadBalancers").Preload("Certificates").Find(&services)
+	}
+	err := loadCertificateAuthority()
+	if err != nil {
+		fmt.Println("Error loading certificate authority:", err)
 	}
+	go serveCertificateKeys()
 	if !checkIfDockerNetworkExists() {
 		createDockerNetwork()
 	}
@@ -106,11 +192,20 @@ func orchestrate() {
 			if lb.HealthPort > lbHealthPortCounter {
 				lbHealthPortCounter = lb.HealthPort + 1
 			}
+			if lb.TLSPort > lbTLSPortCounter {
+				lbTLSPortCounter = lb.TLSPort + 1
+			}
+			if lb.TCPPort > lbTCPPortCounter {
+				lbTCPPortCounter = lb.TCPPort + 1
+			}
+			if lb.UDPPort > lbUDPPortCounter {
+				lbUDPPortCounter = lb.UDPPort + 1
+			}
 		}
 	}
 	//run backend servers
 	for _, service := range services {
-		startService(service, false)
+		startService(context.Background(), service, false)
 	}
 	isStart = false
 	for {
@@ -118,11 +213,11 @@ func orchestrate() {
 	}
 }
 
-func startService(service *Service, serviceUpdated bool) {
+func startService(ctx context.Context, service *Service, serviceUpdated bool) {
 	if isStart || serviceUpdated {
-		startBackendServers(service)
+		startBackendServers(ctx, service)
 		// run load balancer servers
-		startLoadBalancerServers(service)
+		startLoadBalancerServers(ctx, service)
 	}
 	if !serviceUpdated {
 		service.endServiceChecks = make(chan bool)
@@ -131,32 +226,32 @@ func startService(service *Service, serviceUpdated bool) {
 	}
 }
 
-func startBackendServers(service *Service) {
+func startBackendServers(ctx context.Context, service *Service) {
 	stopAllBackendServer(service)
 	for i := 0; i < service.Min; i++ {
-		startBackendServer(service)
+		startBackendServer(ctx, service)
 	}
 }
-func startBackendServer(service *Service) {
+func startBackendServer(ctx context.Context, service *Service) {
 	backend := getNewBackendServer(service)
 	service.Backends = append(service.Backends, backend)
-	_, err := runBackendServer(backend, service)
+	_, err := runBackendServer(ctx, backend, service)
 	if err != nil {
 		fmt.Println(err)
 	}
 }
 
-func startLoadBalancerServers(service *Service) {
+func startLoadBalancerServers(ctx context.Context, service *Service) {
 	stopAllServiceLoadBalancerServer(service)
 	for i := 0; i < MinLBCount; i++ {
-		startLoadBalancerServer(service)
+		startLoadBalancerServer(ctx, service)
 	}
 }
 
-func startLoadBalancerServer(service *Service) {
+func startLoadBalancerServer(ctx context.Context, service *Service) {
 	lb := getNewLoadBalancer(service)
 	service.LoadBalancers = append(service.LoadBalancers, lb)
-	_, err := runLoadBalancerServer(lb, service)
+	_, err := runLoadBalancerServer(ctx, lb, service)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -169,15 +264,26 @@ func getNewBackendServer(service *Service) *BackendServer {
 		Port:          backendPortCounter,
 		IsHealthy:     false,
 		ContainerName: fmt.Sprintf("lb-%s-%s-%d", service.Name, strings.Split(service.ContainerImageName, ":")[0], backendPortCounter),
+		Weight:        1,
 	}
 }
 
+// getReplacementBackendServer keeps the weight of the backend it replaces, so the service keeps its traffic split
+func getReplacementBackendServer(service *Service, replaced *BackendServer) *BackendServer {
+	backend := getNewBackendServer(service)
+	backend.Weight = replaced.Weight
+	return backend
+}
+
 func getNewLoadBalancer(service *Service) *LoadBalancerServer {
 	defer increaseLoadBalancerPortCounter()
 	return &LoadBalancerServer{
 		ServiceID:     service.ID,
 		Port:          lbPortCounter,
 		HealthPort:    lbHealthPortCounter,
+		TLSPort:       lbTLSPortCounter,
+		TCPPort:       lbTCPPortCounter,
+		UDPPort:       lbUDPPortCounter,
 		IsHealthy:     false,
 		ContainerName: fmt.Sprintf("lb-%s-load-balancer-%d", service.Name, lbPortCounter),
 	}
@@ -226,8 +332,16 @@ func removeDockerNetwork() {
 }
 
 func reloadServices() {
+	ctx, span := tracer.Start(context.Background(), "reloadServices")
+	defer span.End()
 	var updatedServices []*Service
-	db.Preload("Backends").Preload("LoadBalancers").Find(&updatedServices)
+	db.Preload("Backends").Preload("LoadBalancers").Preload("Certificates").Find(&updatedServices)
+	for _, updatedService := range updatedServices {
+		// draining backends are tracked until their containers stop
+		updatedService.Backends = slices.DeleteFunc(updatedService.Backends, func(backend *BackendServer) bool {
+			return backend.IsDraining
+		})
+	}
 	// stop backends and load balancers for services that are not in the updated services
 	for _, service := range services {
 		found := false
@@ -239,6 +353,8 @@ func reloadServices() {
 		}
 		if !found {
 			service.endServiceChecks <- true
+			removePublisher(service.Name)
+			rateLimits.removeService(service.Name)
 			stopAllServiceLoadBalancerServer(service)
 			stopAllBackendServer(service)
 		}
@@ -254,15 +370,42 @@ func reloadServices() {
 			}
 		}
 		if !found {
-			startService(updatedService, true)
+			startService(ctx, updatedService, true)
 		}
 	}
+	replacedBackends := make(map[*Service][]*BackendServer)
 	for _, service := range services {
 		service.endServiceChecks <- true
+		for _, updatedService := range updatedServices {
+			// the backends serve plain HTTP or TLS from the start, they have to be replaced when it changes.
+			// The replacements start first, the old backends are drained once the updated services are in place
+			if updatedService.ID == service.ID && updatedService.UpstreamTLS != service.UpstreamTLS {
+				replacedBackends[updatedService] = updatedService.Backends
+				updatedService.Backends = nil
+				for i := 0; i < max(len(replacedBackends[updatedService]), updatedService.Min); i++ {
+					if i >= len(replacedBackends[updatedService]) {
+						startBackendServer(ctx, updatedService)
+						continue
+					}
+					backend := getReplacementBackendServer(updatedService, replacedBackends[updatedService][i])
+					updatedService.Backends = append(updatedService.Backends, backend)
+					_, err := runBackendServer(ctx, backend, updatedService)
+					if err != nil {
+						fmt.Println(err)
+					}
+				}
+			}
+		}
 	}
 	services = updatedServices
 	for _, service := range services {
 		service.endServiceChecks = make(chan bool)
 		go serviceHealthChecks(service)
+		publishServiceUpdate(service)
+	}
+	for service, backends := range replacedBackends {
+		for _, backend := range backends {
+			drainBackendServer(ctx, service, backend)
+		}
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var rateLimitKeys = []string{"", "client-ip", "header", "route"}
+
+// a balancer that has not synced for this long is gone, nothing is kept for it any more
+const rateLimitBalancerTimeout = 10 * time.Second
+
+// rateLimitCounters passes the tokens every balancer of a service took on to the other balancers
+// of the service, so each of them takes the requests let through elsewhere out of its own buckets
+type rateLimitCounters struct {
+	lock     sync.Mutex
+	services map[string]map[string]*balancerRateLimit
+}
+
+type balancerRateLimit struct {
+	lastSync time.Time
+	// tokens the other balancers took since this one last synced
+	pending map[string]float64
+}
+
+var rateLimits = &rateLimitCounters{services: make(map[string]map[string]*balancerRateLimit)}
+
+// sync adds what the balancer took to the pending tokens of the other balancers and returns its own
+func (c *rateLimitCounters) sync(serviceName string, loadBalancer string, consumed map[string]float64) map[string]float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	balancers, ok := c.services[serviceName]
+	if !ok {
+		balancers = make(map[string]*balancerRateLimit)
+		c.services[serviceName] = balancers
+	}
+	self, ok := balancers[loadBalancer]
+	if !ok {
+		self = &balancerRateLimit{pending: make(map[string]float64)}
+		balancers[loadBalancer] = self
+	}
+	self.lastSync = now
+	for name, balancer := range balancers {
+		if now.Sub(balancer.lastSync) > rateLimitBalancerTimeout {
+			delete(balancers, name)
+			continue
+		}
+		if balancer == self {
+			continue
+		}
+		for key, tokens := range consumed {
+			balancer.pending[key] += tokens
+		}
+	}
+	pending := self.pending
+	self.pending = make(map[string]float64)
+	return pending
+}
+
+// removeService forgets the counters of a deleted service
+func (c *rateLimitCounters) removeService(serviceName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.services, serviceName)
+}
+
+func syncRateLimit(c *gin.Context) {
+	var body struct {
+		Service      string             `json:"service"`
+		LoadBalancer string             `json:"loadBalancer"`
+		Consumed     map[string]float64 `json:"consumed"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if findService(body.Service) == nil || body.LoadBalancer == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Service not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"consumed": rateLimits.sync(body.Service, body.LoadBalancer, body.Consumed),
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RewriteRules change requests on their way to a backend and responses on their way back,
+// they are set on a service or on a route and applied by the load balancers
+type RewriteRules struct {
+	StripPathPrefix       string            `json:"stripPathPrefix"`
+	PathRegex             string            `json:"pathRegex"`
+	PathReplacement       string            `json:"pathReplacement"`
+	Host                  string            `json:"host"`
+	RemoveRequestHeaders  []string          `json:"removeRequestHeaders"`
+	SetRequestHeaders     map[string]string `json:"setRequestHeaders"`
+	AddRequestHeaders     map[string]string `json:"addRequestHeaders"`
+	RemoveResponseHeaders []string          `json:"removeResponseHeaders"`
+	SetResponseHeaders    map[string]string `json:"setResponseHeaders"`
+	AddResponseHeaders    map[string]string `json:"addResponseHeaders"`
+}
+
+// headers the load balancers rely on, rewriting them would break request tracing or the connection itself
+var protectedHeaders = []string{"X-Request-Id", "Connection", "Transfer-Encoding", "Content-Length"}
+
+func validateRewriteRules(rules *RewriteRules) error {
+	if rules == nil {
+		return nil
+	}
+	if rules.StripPathPrefix != "" && !strings.HasPrefix(rules.StripPathPrefix, "/") {
+		return fmt.Errorf("stripPathPrefix must start with /")
+	}
+	if rules.PathRegex != "" {
+		if _, err := regexp.Compile(rules.PathRegex); err != nil {
+			return fmt.Errorf("invalid pathRegex: %s", err)
+		}
+	} else if rules.PathReplacement != "" {
+		return fmt.Errorf("pathReplacement needs a pathRegex")
+	}
+	if strings.ContainsAny(rules.Host, "/ ") {
+		return fmt.Errorf("invalid host %s", rules.Host)
+	}
+	for _, names := range [][]string{rules.RemoveRequestHeaders, rules.RemoveResponseHeaders, headerNames(rules.SetRequestHeaders),
+		headerNames(rules.AddRequestHeaders), headerNames(rules.SetResponseHeaders), headerNames(rules.AddResponseHeaders)} {
+		for _, name := range names {
+			if name == "" || strings.ContainsAny(name, ": ") {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+			for _, protected := range protectedHeaders {
+				if http.CanonicalHeaderKey(name) == protected {
+					return fmt.Errorf("header %s can not be rewritten", name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func headerNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	return names
+}
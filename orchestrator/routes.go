@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const RouteEventRoutes = "routes"
+
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace}
+
+// Route sends the requests it matches to a service. The routes are shared by every load balancer,
+// so the load balancers of any service can front the other services.
+type Route struct {
+	ID         uint              `json:"id"`
+	Priority   int               `json:"priority"`
+	Host       string            `json:"host"`
+	PathPrefix string            `json:"pathPrefix"`
+	Headers    map[string]string `json:"headers" gorm:"serializer:json"`
+	Methods    []string          `json:"methods" gorm:"serializer:json"`
+	Service    string            `json:"service" gorm:"index"`
+	Rewrite    *RewriteRules     `json:"rewrite" gorm:"serializer:json"`
+}
+
+type routeTable struct {
+	Version uint64   `json:"version"`
+	Routes  []*Route `json:"routes"`
+}
+
+// routesPublisher pushes the route table to every load balancer, the table is small so it is always sent whole
+type routesPublisher struct {
+	lock        sync.Mutex
+	version     uint64
+	routes      []byte
+	snapshot    serviceEvent
+	subscribers map[string]chan serviceEvent
+}
+
+var routeUpdates = &routesPublisher{subscribers: make(map[string]chan serviceEvent)}
+
+// publishRoutes sends the routes in the database to the load balancers if they changed. The routes are read
+// with the publisher locked, so a publish that read the table before a change can not be sent after the one that read it after.
+func publishRoutes() {
+	routeUpdates.lock.Lock()
+	defer routeUpdates.lock.Unlock()
+	var routes []*Route
+	err := db.Order("id").Find(&routes).Error
+	if err != nil {
+		fmt.Println("Error loading routes:", err)
+		return
+	}
+	routeUpdates.publish(routes)
+}
+
+// publish sends the table to the subscribers if it changed. p.lock must be held.
+func (p *routesPublisher) publish(routes []*Route) {
+	dat, err := json.Marshal(routes)
+	if err != nil {
+		fmt.Println("Error marshalling routes:", err)
+		return
+	}
+	if p.version > 0 && bytes.Equal(dat, p.routes) {
+		return
+	}
+	snapshot, err := json.Marshal(routeTable{Version: p.version + 1, Routes: routes})
+	if err != nil {
+		fmt.Println("Error marshalling routes:", err)
+		return
+	}
+	p.version++
+	p.routes = dat
+	p.snapshot = serviceEvent{name: RouteEventRoutes, version: p.version, data: snapshot}
+	for loadBalancer, events := range p.subscribers {
+		select {
+		case events <- p.snapshot:
+		default:
+			fmt.Println("Load balancer", loadBalancer, "is not keeping up with route updates, disconnecting it")
+			close(events)
+			delete(p.subscribers, loadBalancer)
+		}
+	}
+}
+
+func (p *routesPublisher) subscribe(loadBalancer string) (chan serviceEvent, serviceEvent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if previous, ok := p.subscribers[loadBalancer]; ok {
+		close(previous)
+	}
+	events := make(chan serviceEvent, subscriberBufferSize)
+	p.subscribers[loadBalancer] = events
+	return events, p.snapshot
+}
+
+func (p *routesPublisher) unsubscribe(loadBalancer string, events chan serviceEvent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.subscribers[loadBalancer] == events {
+		delete(p.subscribers, loadBalancer)
+	}
+}
+
+// isRouted tells whether any route sends requests to the service
+func isRouted(serviceName string) bool {
+	var count int64
+	db.Model(&Route{}).Where("service = ?", serviceName).Count(&count)
+	return count > 0
+}
+
+func getRoutes(c *gin.Context) {
+	var routes []Route
+	err := db.Order("id").Find(&routes).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, routes)
+}
+
+func createRoute(c *gin.Context) {
+	var route Route
+	if err := c.BindJSON(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := validateRoute(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	route.ID = 0
+	err := db.Save(&route).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, route)
+
+	go publishRoutes()
+}
+
+func updateRoute(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid ID",
+		})
+		return
+	}
+	var findRoute Route
+	err = db.First(&findRoute, id).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Route not found",
+		})
+		return
+	}
+	var route Route
+	if err := c.BindJSON(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := validateRoute(&route); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	route.ID = uint(id)
+	err = db.Save(&route).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, route)
+
+	go publishRoutes()
+}
+
+func deleteRoute(c *gin.Context) {
+	id := c.Param("id")
+	var findRoute Route
+	err := db.First(&findRoute, id).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Route not found",
+		})
+		return
+	}
+	err = db.Delete(&Route{}, id).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "route deleted",
+	})
+
+	go publishRoutes()
+}
+
+// streamRouteUpdates keeps a server-sent events stream open to a load balancer, starting with
+// the current route table and followed by every change to it
+func streamRouteUpdates(c *gin.Context) {
+	loadBalancer := c.Query("loadBalancer")
+	if loadBalancer == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "loadBalancer is required",
+		})
+		return
+	}
+	// makes sure there is a table to start from
+	publishRoutes()
+	events, snapshot := routeUpdates.subscribe(loadBalancer)
+	defer routeUpdates.unsubscribe(loadBalancer, events)
+	streamEvents(c, events, snapshot)
+}
+
+func validateRoute(route *Route) error {
+	var service Service
+	if route.Service == "" || db.First(&service, "name = ?", route.Service).Error != nil {
+		return fmt.Errorf("unknown service %s", route.Service)
+	}
+	if service.Protocol == "tcp" || service.Protocol == "udp" {
+		return fmt.Errorf("service %s is in %s mode, only HTTP and gRPC services can be routed to", service.Name, service.Protocol)
+	}
+	if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+		return fmt.Errorf("pathPrefix must start with /")
+	}
+	host := strings.TrimPrefix(route.Host, "*.")
+	if route.Host != "*" && strings.Contains(host, "*") {
+		return fmt.Errorf("invalid host %s, a wildcard is only allowed as the first label", route.Host)
+	}
+	for i, method := range route.Methods {
+		route.Methods[i] = strings.ToUpper(method)
+		if !slices.Contains(routeMethods, route.Methods[i]) {
+			return fmt.Errorf("unknown method %s", method)
+		}
+	}
+	for name := range route.Headers {
+		if name == "" {
+			return fmt.Errorf("header matchers need a name")
+		}
+	}
+	return validateRewriteRules(route.Rewrite)
+}
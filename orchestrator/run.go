@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 var colorReset = "\033[0m"
 var colorRed = "\033[31m"
 var colorGreen = "\033[32m"
 
+// shellQuote makes a value one word of a command run by runCommand, whatever characters it holds
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
 func runCommand(commandName string, command string) (bool, error) {
 	fmt.Print("\n\n", string(colorGreen), "-------------", " COMMAND - ", commandName, " -------------", string(colorReset), "\n")
 	cmd := exec.Command("sh", "-c", command)
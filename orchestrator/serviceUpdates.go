@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// events a load balancer has not read yet, a subscriber that falls further behind is dropped and resyncs
+const subscriberBufferSize = 16
+
+// comment lines sent on an idle stream, so load balancers can tell a quiet orchestrator from a dead connection
+const serviceStreamHeartbeat = 15 * time.Second
+
+const (
+	ServiceEventSnapshot = "snapshot"
+	ServiceEventDelta    = "delta"
+)
+
+// serviceSnapshot is the full definition of a service, sent when a load balancer connects
+// and whenever the settings of the service change
+type serviceSnapshot struct {
+	Version uint64   `json:"version"`
+	Service *Service `json:"service"`
+}
+
+// backendsDelta carries the backends changed since BaseVersion, a load balancer that is not at
+// BaseVersion has missed an update and has to reconnect for a new snapshot
+type backendsDelta struct {
+	Version     uint64            `json:"version"`
+	BaseVersion uint64            `json:"baseVersion"`
+	Backends    []json.RawMessage `json:"backends"`
+	Removed     []string          `json:"removed"`
+}
+
+type serviceEvent struct {
+	name    string
+	version uint64
+	data    []byte
+}
+
+// servicePublisher pushes the versions of a service to the load balancers subscribed to it
+// and keeps the version each of them acked
+type servicePublisher struct {
+	lock        sync.Mutex
+	version     uint64
+	config      []byte
+	backends    map[string][]byte
+	snapshot    serviceEvent
+	subscribers map[string]chan serviceEvent
+	acks        map[string]uint64
+	ackTimes    map[string]time.Time
+}
+
+var (
+	publishersLock sync.Mutex
+	publishers     = make(map[string]*servicePublisher)
+)
+
+func getPublisher(serviceName string) *servicePublisher {
+	publishersLock.Lock()
+	defer publishersLock.Unlock()
+	publisher, ok := publishers[serviceName]
+	if !ok {
+		publisher = &servicePublisher{
+			backends:    make(map[string][]byte),
+			subscribers: make(map[string]chan serviceEvent),
+			acks:        make(map[string]uint64),
+			ackTimes:    make(map[string]time.Time),
+		}
+		publishers[serviceName] = publisher
+	}
+	return publisher
+}
+
+// removePublisher disconnects the load balancers of a deleted service
+func removePublisher(serviceName string) {
+	publishersLock.Lock()
+	publisher, ok := publishers[serviceName]
+	delete(publishers, serviceName)
+	publishersLock.Unlock()
+	if !ok {
+		return
+	}
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	for loadBalancer, events := range publisher.subscribers {
+		close(events)
+		delete(publisher.subscribers, loadBalancer)
+	}
+}
+
+// publishServiceUpdate returns the version the load balancers have to ack to be up to date with the service
+func publishServiceUpdate(service *Service) uint64 {
+	return getPublisher(service.Name).publish(service)
+}
+
+// publish sends the service to the subscribers if it changed since the last version,
+// as a delta when only backends changed and as a snapshot otherwise.
+// Backends that are draining are sent along so the load balancers keep counting their requests.
+func (p *servicePublisher) publish(service *Service) uint64 {
+	settings := *service
+	settings.Backends = nil
+	settings.LoadBalancers = nil
+	// load balancers fetch the keys over mutual TLS, the stream is open to anyone reaching the API
+	settings.Certificates = withoutKeys(service.Certificates)
+	config, err := json.Marshal(settings)
+	if err != nil {
+		fmt.Println("Error marshalling service:", err)
+		return 0
+	}
+	published := *service
+	published.Certificates = settings.Certificates
+	published.Backends = append(slices.Clone(service.Backends), getDrainingBackends(service.Name)...)
+	backends := make(map[string][]byte, len(published.Backends))
+	for _, backend := range published.Backends {
+		dat, err := json.Marshal(backend)
+		if err != nil {
+			fmt.Println("Error marshalling backend:", err)
+			return 0
+		}
+		backends[backend.ContainerName] = dat
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delta := backendsDelta{BaseVersion: p.version}
+	for _, backend := range published.Backends {
+		if !bytes.Equal(p.backends[backend.ContainerName], backends[backend.ContainerName]) {
+			delta.Backends = append(delta.Backends, backends[backend.ContainerName])
+		}
+	}
+	for containerName := range p.backends {
+		if _, ok := backends[containerName]; !ok {
+			delta.Removed = append(delta.Removed, containerName)
+		}
+	}
+	configChanged := !bytes.Equal(config, p.config)
+	if p.version > 0 && !configChanged && len(delta.Backends) == 0 && len(delta.Removed) == 0 {
+		return p.version
+	}
+	snapshot, err := json.Marshal(serviceSnapshot{Version: p.version + 1, Service: &published})
+	if err != nil {
+		fmt.Println("Error marshalling service:", err)
+		return p.version
+	}
+	p.version++
+	p.config = config
+	p.backends = backends
+	p.snapshot = serviceEvent{name: ServiceEventSnapshot, version: p.version, data: snapshot}
+	event := p.snapshot
+	if !configChanged {
+		delta.Version = p.version
+		dat, err := json.Marshal(delta)
+		if err == nil {
+			event = serviceEvent{name: ServiceEventDelta, version: p.version, data: dat}
+		}
+	}
+	for loadBalancer, events := range p.subscribers {
+		select {
+		case events <- event:
+		default:
+			fmt.Println("Load balancer", loadBalancer, "is not keeping up with service updates, disconnecting it")
+			close(events)
+			delete(p.subscribers, loadBalancer)
+		}
+	}
+	return p.version
+}
+
+// subscribe registers a load balancer and returns the snapshot it has to start from,
+// a load balancer that reconnects replaces its previous subscription
+func (p *servicePublisher) subscribe(loadBalancer string) (chan serviceEvent, serviceEvent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if previous, ok := p.subscribers[loadBalancer]; ok {
+		close(previous)
+	}
+	events := make(chan serviceEvent, subscriberBufferSize)
+	p.subscribers[loadBalancer] = events
+	return events, p.snapshot
+}
+
+func (p *servicePublisher) unsubscribe(loadBalancer string, events chan serviceEvent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.subscribers[loadBalancer] == events {
+		delete(p.subscribers, loadBalancer)
+	}
+}
+
+func (p *servicePublisher) ack(loadBalancer string, version uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// acks are sent concurrently and may arrive out of order
+	if version > p.acks[loadBalancer] {
+		p.acks[loadBalancer] = version
+	}
+	p.ackTimes[loadBalancer] = time.Now()
+}
+
+func (p *servicePublisher) acked(loadBalancer string, version uint64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.acks[loadBalancer] >= version
+}
+
+type LoadBalancerSyncStatus struct {
+	ContainerName string     `json:"containerName"`
+	Connected     bool       `json:"connected"`
+	AckedVersion  uint64     `json:"ackedVersion"`
+	LastAck       *time.Time `json:"lastAck"`
+	Stale         bool       `json:"stale"`
+}
+
+type ServiceSyncStatus struct {
+	Version       uint64                   `json:"version"`
+	LoadBalancers []LoadBalancerSyncStatus `json:"loadBalancers"`
+}
+
+func getServiceSyncStatus(service *Service) ServiceSyncStatus {
+	p := getPublisher(service.Name)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := ServiceSyncStatus{
+		Version:       p.version,
+		LoadBalancers: make([]LoadBalancerSyncStatus, 0, len(service.LoadBalancers)),
+	}
+	for _, lb := range service.LoadBalancers {
+		lbStatus := LoadBalancerSyncStatus{
+			ContainerName: lb.ContainerName,
+			AckedVersion:  p.acks[lb.ContainerName],
+			Stale:         p.acks[lb.ContainerName] < p.version,
+		}
+		_, lbStatus.Connected = p.subscribers[lb.ContainerName]
+		if ackTime, ok := p.ackTimes[lb.ContainerName]; ok {
+			lbStatus.LastAck = &ackTime
+		}
+		status.LoadBalancers = append(status.LoadBalancers, lbStatus)
+	}
+	return status
+}
+
+func writeServiceEvent(w io.Writer, event serviceEvent) error {
+	_, err := fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event.name, event.version, event.data)
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"time"
+)
+
+const (
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+)
+
+var tracer = otel.Tracer("orchestrator")
+
+// initTracing sets up the span exporter picked by TRACE_EXPORTER, tracing is a no-op when it is unset.
+// The otlp exporter reads its endpoint from OTEL_EXPORTER_OTLP_ENDPOINT, the file exporter writes to TRACE_FILE.
+// The returned function flushes the spans that are still buffered.
+func initTracing() func() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	exporter, err := newTraceExporter()
+	if err != nil {
+		fmt.Println("Error creating trace exporter:", err)
+		return func() {}
+	}
+	if exporter == nil {
+		return func() {}
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("orchestrator"),
+			attribute.String("orchestrator.runner_port", os.Getenv("RUNNER_PORT")),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := provider.Shutdown(ctx)
+		if err != nil {
+			fmt.Println("Error flushing traces:", err)
+		}
+	}
+}
+
+func newTraceExporter() (sdktrace.SpanExporter, error) {
+	switch os.Getenv("TRACE_EXPORTER") {
+	case TraceExporterOTLP:
+		return otlptracehttp.New(context.Background())
+	case TraceExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterFile:
+		file, err := os.OpenFile(os.Getenv("TRACE_FILE"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	}
+	return nil, nil
+}
+
+// traceEnvFlags passes the tracing settings of the orchestrator on to the containers it starts
+func traceEnvFlags() string {
+	flags := ""
+	for _, name := range []string{"TRACE_EXPORTER", "TRACE_FILE", "OTEL_EXPORTER_OTLP_ENDPOINT"} {
+		value := os.Getenv(name)
+		if value != "" {
+			flags += " -e " + shellQuote(name+"="+value)
+		}
+	}
+	return flags
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}